@@ -11,8 +11,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -37,6 +40,22 @@ func receiverCli(cmdName string, args []string) error {
 	cmd := buildFlagSet("receiver")
 	listen := cmd.String("listen", ":"+DefaultPort, "Listen to this address")
 	targetPath := cmd.String("target", "", "Target path to write to")
+	recursive := cmd.Bool("recursive", true, "Allow senders to recreate subdirectories below the target")
+	preserveModTime := cmd.Bool("preserve-mtime", true, "Apply the modification time of the sender to files")
+	preserveMode := cmd.Bool("preserve-mode", false, "Apply the permission bits of the sender to files")
+	partialExpire := cmd.Duration("partial-expire", receiver.DefaultPartialExpire,
+		"Keep interrupted transfers for resuming this long, 0 disables resuming")
+	journal := cmd.String("journal", "",
+		"File to remember delivered files in, so files sent again are not delivered twice")
+	journalRetention := cmd.Duration("journal-retention", receiver.DefaultJournalRetention,
+		"Time delivered files are remembered in the journal")
+	owner := cmd.String("owner", receiver.OwnerNone,
+		"Apply ownership of the sender to files (none, id or name)")
+	route := cmd.String("route", "",
+		"Subdirectory for the files of a sender, with the placeholders "+
+			receiver.RouteCert+", "+receiver.RouteIdentity+" and "+receiver.RouteDate)
+	collision := cmd.String("collision", receiver.CollisionOverwrite,
+		"Policy for files that already exist (overwrite, reject, counter, timestamp or sender)")
 
 	var peerNames util.ArrayFlags
 	cmd.Var(&peerNames, "allow", "Allowed client certificate names, can be repeated to build a list")
@@ -55,6 +74,27 @@ func receiverCli(cmdName string, args []string) error {
 		return fmt.Errorf("please specify --target")
 	}
 
+	if *partialExpire < 0 {
+		return fmt.Errorf("--partial-expire must not be negative")
+	}
+
+	if *journalRetention <= 0 {
+		return fmt.Errorf("--journal-retention must be positive")
+	}
+
+	switch *owner {
+	case receiver.OwnerNone, receiver.OwnerId, receiver.OwnerName:
+	default:
+		return fmt.Errorf("invalid value for --owner: %s", *owner)
+	}
+
+	switch *collision {
+	case receiver.CollisionOverwrite, receiver.CollisionReject, receiver.CollisionCounter,
+		receiver.CollisionTimestamp, receiver.CollisionSender:
+	default:
+		return fmt.Errorf("invalid value for --collision: %s", *collision)
+	}
+
 	if *tlsCert == "" {
 		return fmt.Errorf("please specify --cert")
 	}
@@ -89,9 +129,37 @@ func receiverCli(cmdName string, args []string) error {
 		return fmt.Errorf("could not setup FileWriter: %s", err)
 	}
 
+	writer.PreserveModTime = *preserveModTime
+	writer.PreserveMode = *preserveMode
+	writer.Owner = *owner
+	writer.PartialExpire = *partialExpire
+	writer.Collision = *collision
+
+	if err := writer.ExpirePartials(); err != nil {
+		return err
+	}
+
 	r := receiver.NewReceiver(*listen, writer)
 	r.TlsConfig = tlsConfig
 	r.PeerNames = peerNames
+	r.Identity = fqdn.Get()
+	r.Recursive = *recursive
+	r.Route = *route
+
+	if *journal != "" {
+		j := receiver.NewJournal(*journal)
+		j.Retention = *journalRetention
+
+		if err := j.Open(); err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = j.Close()
+		}()
+
+		r.Journal = j
+	}
 
 	if err = r.Open(); err != nil {
 		return fmt.Errorf("could not open listener: %s", err)
@@ -99,9 +167,17 @@ func receiverCli(cmdName string, args []string) error {
 
 	signals := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
+	quit := make(chan bool)
 
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
+	defer close(quit)
+
+	if writer.PartialExpire > 0 {
+		// transfers interrupted while running are not resumed forever either
+		go writer.RunExpirePartials(receiver.PartialExpireInterval, quit)
+	}
+
 	go func() {
 		sig := <-signals
 		log.Printf("Got signal %v from OS", sig)
@@ -122,8 +198,73 @@ func receiverCli(cmdName string, args []string) error {
 
 func senderCli(cmdName string, args []string) error {
 	cmd := flag.NewFlagSet("sender", flag.ContinueOnError)
-	connect := cmd.String("connect", "", "Send to this TCP address")
+	var connect util.ArrayFlags
+	cmd.Var(&connect, "connect", "Send to this TCP address, can be repeated to add receivers for failover")
+	failover := cmd.String("failover", sender.FailoverPriority,
+		"Policy for choosing the next receiver when one fails (priority or round-robin)")
+	failbackInterval := cmd.Duration("failback-interval", sender.DefaultFailbackInterval,
+		"Interval for checks whether the first receiver is available again, 0 disables returning to it")
+	fanOut := cmd.Bool("fan-out", false,
+		"Send every file to all receivers given with --connect, instead of failing over between them")
+	quorum := cmd.Int("quorum", 0, "Number of receivers that must have a file before it is removed in fan-out mode, 0 for all")
+	progressPath := cmd.String("progress", "",
+		"File to track which receivers have a file in fan-out mode, by default "+sender.ProgressFile+" in the source")
 	sourcePath := cmd.String("source", "", "Source path to read from")
+	recursive := cmd.Bool("recursive", false, "Include files in subdirectories, and remove directories when empty")
+	watch := cmd.Bool("watch", true, "Watch the source for new files, instead of checking every few seconds")
+	rescanInterval := cmd.Duration("rescan-interval", sender.RescanInterval*time.Second,
+		"Interval for full checks of the source while watching")
+	minAge := cmd.Duration("min-age", 0, "Only send files that have not been modified for this long")
+	stableSize := cmd.Bool("stable-size", false, "Only send files when their size did not change between two checks")
+	readyMarker := cmd.String("ready-marker", "",
+		"Only send files when a companion file with this suffix exists, e.g. .ready")
+
+	var ignoreSuffixes util.ArrayFlags
+	cmd.Var(&ignoreSuffixes, "ignore-suffix", "Ignore files still being written with this suffix, e.g. .tmp, can be repeated")
+
+	var include, exclude, includeRegex, excludeRegex util.ArrayFlags
+	cmd.Var(&include, "include", "Only send files matching this glob pattern, can be repeated")
+	cmd.Var(&exclude, "exclude", "Do not send files matching this glob pattern, can be repeated")
+	cmd.Var(&includeRegex, "include-regex", "Only send files matching this regular expression, can be repeated")
+	cmd.Var(&excludeRegex, "exclude-regex", "Do not send files matching this regular expression, can be repeated")
+
+	order := cmd.String("order", sender.OrderName, "Order to send files in (name, oldest or smallest)")
+
+	var priority util.ArrayFlags
+	cmd.Var(&priority, "priority",
+		"Send files or subdirectories with this prefix before others, can be repeated in order of priority")
+
+	batchFiles := cmd.Int("batch-files", sender.DefaultBatchFiles,
+		"Maximum number of files read from the source at once, 0 for unlimited")
+	batchBytes := cmd.Int64("batch-bytes", 0, "Maximum size of files read from the source at once, 0 for unlimited")
+
+	window := cmd.Int("window", sender.DefaultWindow, "Number of files sent before waiting for acknowledgements")
+	workers := cmd.Int("workers", 1, "Number of parallel connections to the receiver")
+	maxRetries := cmd.Int("max-retries", sender.DefaultMaxRetries,
+		"Failed attempts before a file is moved to the failed directory of the source, 0 retries forever")
+	resumeSize := cmd.Int64("resume-size", sender.DefaultResumeSize,
+		"Minimum size of files that are resumed after an interrupted transfer, 0 disables resuming")
+
+	reconnectMin := cmd.Duration("reconnect-min", sender.DefaultReconnectMin,
+		"Delay after the first failed connection attempt, doubled for every further attempt")
+	reconnectMax := cmd.Duration("reconnect-max", sender.DefaultReconnectMax,
+		"Maximum delay between connection attempts")
+	reconnectReset := cmd.Duration("reconnect-reset", sender.DefaultReconnectReset,
+		"Time a connection must stay up before the reconnect delay is reset, 0 resets it on every successful handshake")
+
+	sendOwner := cmd.Bool("send-owner", false, "Include owner and group of files, so the receiver can apply them")
+	checksum := cmd.String("checksum", sender.DefaultChecksum,
+		"Checksum to verify files with ("+strings.Join(sender.ChecksumAlgorithms(), ", ")+" or none)")
+
+	archive := cmd.String("archive", "",
+		"Move files to this directory after sending instead of deleting them, relative paths are inside the source")
+	archiveBucket := cmd.String("archive-bucket", "none", "Sort archived files by date (none, monthly, daily or hourly)")
+	archiveMaxAge := cmd.Duration("archive-max-age", 0, "Remove files archived longer ago, 0 keeps them")
+	archiveMaxBytes := cmd.Int64("archive-max-bytes", 0,
+		"Remove the oldest archived files when the archive gets larger, 0 for unlimited")
+
+	compress := cmd.String("compress", "none",
+		"Compress file content when the receiver supports it ("+strings.Join(sender.CompressionAlgorithms(), ", ")+" or none)")
 
 	tlsCert, tlsKey, caPath := askForTLSSettings(cmd)
 
@@ -135,7 +276,7 @@ func senderCli(cmdName string, args []string) error {
 		return fmt.Errorf("found extra arguments: %v", flag.Args())
 	}
 
-	if *connect == "" {
+	if len(connect) == 0 {
 		return fmt.Errorf("please specify --connect")
 	}
 	if *sourcePath == "" {
@@ -149,8 +290,73 @@ func senderCli(cmdName string, args []string) error {
 		return fmt.Errorf("please specify --key")
 	}
 
-	if !strings.Contains(*connect, ":") {
-		*connect = *connect + ":" + DefaultPort
+	if err := sender.ValidateOrder(*order); err != nil {
+		return err
+	}
+
+	if *window < 1 || *window > sender.MaxWindow {
+		return fmt.Errorf("--window must be between 1 and %d", sender.MaxWindow)
+	}
+
+	if *workers < 1 || *workers > sender.MaxWorkers {
+		return fmt.Errorf("--workers must be between 1 and %d", sender.MaxWorkers)
+	}
+
+	if *compress == "none" {
+		*compress = ""
+	}
+	if err := sender.ValidateCompression(*compress); err != nil {
+		return err
+	}
+
+	if *rescanInterval <= 0 {
+		return fmt.Errorf("--rescan-interval must be positive")
+	}
+
+	if *resumeSize < 0 {
+		return fmt.Errorf("--resume-size must not be negative")
+	}
+
+	if *maxRetries < 0 {
+		return fmt.Errorf("--max-retries must not be negative")
+	}
+
+	if err := sender.ValidateFailover(*failover); err != nil {
+		return err
+	}
+	if *failbackInterval < 0 {
+		return fmt.Errorf("--failback-interval must not be negative")
+	}
+
+	if *quorum < 0 || *quorum > len(connect) {
+		return fmt.Errorf("--quorum must be between 0 and the number of receivers")
+	}
+	if !*fanOut && (*quorum > 0 || *progressPath != "") {
+		return fmt.Errorf("--quorum and --progress are only used with --fan-out")
+	}
+
+	if *reconnectMin <= 0 || *reconnectMax < *reconnectMin {
+		return fmt.Errorf("--reconnect-min must be positive, and not larger than --reconnect-max")
+	}
+
+	bucketLayout, ok := sender.ArchiveBuckets[*archiveBucket]
+	if !ok {
+		return fmt.Errorf("invalid value for --archive-bucket: %s", *archiveBucket)
+	}
+	if *archiveMaxAge < 0 || *archiveMaxBytes < 0 {
+		return fmt.Errorf("--archive-max-age and --archive-max-bytes must not be negative")
+	}
+
+	if *checksum == "none" {
+		*checksum = ""
+	} else if _, err := sender.NewChecksum(*checksum); err != nil {
+		return err
+	}
+
+	for i := range connect {
+		if !strings.Contains(connect[i], ":") {
+			connect[i] = connect[i] + ":" + DefaultPort
+		}
 	}
 
 	config := util.TlsConfig{
@@ -164,7 +370,7 @@ func senderCli(cmdName string, args []string) error {
 		return err
 	}
 
-	log.Printf("Starting sender to %s", *connect)
+	log.Printf("Starting sender to %s", strings.Join(connect, ", "))
 	log.Printf("Reading data from %s", *sourcePath)
 
 	r, err := sender.NewFileReader(*sourcePath)
@@ -172,31 +378,168 @@ func senderCli(cmdName string, args []string) error {
 		return fmt.Errorf("could not set up FileReader: %s", err)
 	}
 
+	r.Owner = *sendOwner
+	r.Recursive = *recursive
+	r.Readiness = sender.Readiness{
+		MinAge:         *minAge,
+		StableSize:     *stableSize,
+		IgnoreSuffixes: ignoreSuffixes,
+		ReadyMarker:    *readyMarker,
+	}
+
+	r.Order = *order
+	r.Priority = priority
+	r.BatchFiles = *batchFiles
+	r.BatchBytes = *batchBytes
+	r.Archive = *archive
+	r.ArchiveBucket = bucketLayout
+
+	if r.Include, err = buildFilters(include, includeRegex); err != nil {
+		return err
+	}
+	if r.Exclude, err = buildFilters(exclude, excludeRegex); err != nil {
+		return err
+	}
+
 	signals := make(chan os.Signal, 1)
 	quit := make(chan bool)
 	done := make(chan bool)
 
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	s := sender.NewSender(*connect, r)
-	s.TlsConfig = tlsConfig
+	if *archive != "" {
+		log.Printf("Archiving sent files to %s", r.ArchivePath())
+
+		if *archiveMaxAge > 0 || *archiveMaxBytes > 0 {
+			pruner := sender.NewArchivePruner(r.ArchivePath())
+			pruner.MaxAge = *archiveMaxAge
+			pruner.MaxBytes = *archiveMaxBytes
+
+			go pruner.Run(quit)
+		}
+	}
+
+	newSender := func(addr string, reader *sender.FileReader) *sender.Sender {
+		s := sender.NewSender(addr, reader)
+		s.TlsConfig = tlsConfig
+		s.Checksum = *checksum
+		s.Identity = fqdn.Get()
+		s.Watch = *watch
+		s.RescanInterval = *rescanInterval
+		s.Window = *window
+		s.Workers = *workers
+		s.Compression = *compress
+		s.ResumeSize = *resumeSize
+		s.MaxRetries = *maxRetries
+		s.ReconnectBackoff.Min = *reconnectMin
+		s.ReconnectBackoff.Max = *reconnectMax
+		s.ReconnectReset = *reconnectReset
+		return s
+	}
+
+	var senders []*sender.Sender
+
+	if *fanOut {
+		if *progressPath == "" {
+			*progressPath = path.Join(*sourcePath, sender.ProgressFile)
+		}
+
+		progress := sender.NewProgress(*progressPath, len(connect))
+		progress.Quorum = *quorum
+		if err := progress.Open(); err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = progress.Close()
+		}()
+
+		log.Printf("Sending every file to %d receivers, tracked in %s", len(connect), *progressPath)
+
+		// every destination checks the spool on its own
+		for _, addr := range connect {
+			s := newSender(addr, r.Clone())
+			s.Progress = progress
+			senders = append(senders, s)
+		}
+	} else {
+		s := newSender(connect[0], r)
+		s.Failover = connect[1:]
+		s.FailoverMode = *failover
+		s.FailbackInterval = *failbackInterval
+		senders = append(senders, s)
+	}
+
+	status := make(chan os.Signal, 1)
+	if len(statusSignals) > 0 {
+		signal.Notify(status, statusSignals...)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-status:
+				for _, s := range senders {
+					log.Printf("Status: %s", s.Status())
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
 
 	go func() {
 		sig := <-signals
 		log.Printf("Got signal %v from OS", sig)
-		s.Stop()
+		for _, s := range senders {
+			s.Stop()
+		}
 		close(quit)
 		done <- true
 	}()
 
-	s.Run()
-	_ = s.Close()
+	var wg sync.WaitGroup
+
+	for _, s := range senders {
+		wg.Add(1)
+
+		go func(s *sender.Sender) {
+			defer wg.Done()
+
+			s.Run()
+			_ = s.Close()
+		}(s)
+	}
+
+	wg.Wait()
 
 	<-done
 	log.Println("Exiting sender")
 	return nil
 }
 
+func buildFilters(globs []string, regexes []string) ([]sender.Filter, error) {
+	var filters []sender.Filter
+
+	for _, pattern := range globs {
+		filter, err := sender.NewGlobFilter(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	for _, expr := range regexes {
+		filter, err := sender.NewRegexFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	return filters, nil
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Usage:", os.Args[0], "receiver|sender [options]")
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// statusSignals log the status of the sender, there is no suitable signal on this platform
+var statusSignals []os.Signal
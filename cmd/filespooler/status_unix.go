@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals log the status of the sender
+var statusSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,57 @@
+package receiver
+
+import (
+	"github.com/lazyfrosch/filespooler/sender"
+	"os"
+	"syscall"
+)
+
+// classifyError maps an error from writing a file to the class reported to the sender
+func classifyError(err error) *sender.ResponseError {
+	if e, ok := err.(*sender.ResponseError); ok {
+		return e
+	}
+
+	class := sender.ErrorInternal
+
+	switch {
+	case isChecksumError(err):
+		class = sender.ErrorChecksum
+	case os.IsPermission(err):
+		class = sender.ErrorPermission
+	case os.IsExist(err):
+		class = sender.ErrorExists
+	default:
+		switch errno(err) {
+		case syscall.ENOSPC:
+			class = sender.ErrorDiskFull
+		case syscall.EDQUOT:
+			class = sender.ErrorQuota
+		}
+	}
+
+	return sender.NewResponseError(class, "%s", err)
+}
+
+func isChecksumError(err error) bool {
+	_, ok := err.(*ChecksumError)
+	return ok
+}
+
+// errno returns the system error behind the common os error wrappers
+func errno(err error) syscall.Errno {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	if e, ok := err.(syscall.Errno); ok {
+		return e
+	}
+
+	return 0
+}
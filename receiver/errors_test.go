@@ -0,0 +1,27 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/lazyfrosch/filespooler/sender"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := map[error]string{
+		&ChecksumError{Name: "test"}:                                         sender.ErrorChecksum,
+		&os.PathError{Op: "open", Path: "/test", Err: syscall.EACCES}:        sender.ErrorPermission,
+		&os.PathError{Op: "write", Path: "/test", Err: syscall.ENOSPC}:       sender.ErrorDiskFull,
+		&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EDQUOT}: sender.ErrorQuota,
+		&os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EEXIST}:   sender.ErrorExists,
+		sender.NewResponseError(sender.ErrorNameRejected, "test"):            sender.ErrorNameRejected,
+		fmt.Errorf("something else"):                                         sender.ErrorInternal,
+	}
+
+	for err, expected := range tests {
+		if class := classifyError(err).Class; class != expected {
+			t.Fatalf("error %s classified as %s, expected %s", err, class, expected)
+		}
+	}
+}
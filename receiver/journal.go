@@ -0,0 +1,125 @@
+package receiver
+
+import (
+	"fmt"
+	"github.com/lazyfrosch/filespooler/util"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJournalRetention is the default time delivery ids are remembered
+const DefaultJournalRetention = 7 * 24 * time.Hour
+
+// Journal remembers the delivery ids of received files, so a file sent again is not delivered twice.
+//
+// Every id is appended as a line to a file, and synced before the sender gets its acknowledgement:
+//
+//	<unix time> <delivery id>
+//
+// Entries older than Retention are dropped when the file is compacted.
+type Journal struct {
+	log *util.AppendLog
+	ids map[string]time.Time
+	mu  sync.Mutex
+	// time of the last compaction
+	compacted time.Time
+	// Retention is the time delivery ids are remembered
+	Retention time.Duration
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{
+		log:       util.NewAppendLog(path),
+		ids:       make(map[string]time.Time),
+		Retention: DefaultJournalRetention,
+	}
+}
+
+// Open loads the journal from disk and drops expired entries
+func (j *Journal) Open() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.log.Load(func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			// a line might be incomplete after a crash
+			return
+		}
+
+		ts, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return
+		}
+
+		j.ids[fields[1]] = time.Unix(ts, 0)
+	})
+	if err != nil {
+		return err
+	}
+
+	return j.compact()
+}
+
+// compact rewrites the journal without expired entries
+func (j *Journal) compact() error {
+	now := time.Now()
+
+	err := j.log.Rewrite(func(w io.Writer) {
+		for id, ts := range j.ids {
+			if now.Sub(ts) > j.Retention {
+				delete(j.ids, id)
+				continue
+			}
+
+			_, _ = fmt.Fprintf(w, "%d %s\n", ts.Unix(), id)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	j.compacted = now
+
+	return nil
+}
+
+// Seen returns true when a file with this delivery id has been received within Retention
+func (j *Journal) Seen(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ts, ok := j.ids[id]
+	return ok && time.Since(ts) <= j.Retention
+}
+
+// Add records a delivery id, it is synced to disk before returning
+func (j *Journal) Add(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+
+	if err := j.log.Append(fmt.Sprintf("%d %s", now.Unix(), id)); err != nil {
+		return err
+	}
+
+	j.ids[id] = now
+
+	// expired entries only matter for the size of the file, check them once in a while
+	if now.Sub(j.compacted) > j.Retention/10 {
+		return j.compact()
+	}
+
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.log.Close()
+}
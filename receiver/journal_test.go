@@ -0,0 +1,84 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	journalPath := path.Join(tempPath, "journal")
+
+	j := NewJournal(journalPath)
+	if err := j.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Seen("abc") {
+		t.Fatal("empty journal should not know any id")
+	}
+	if err := j.Add("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if !j.Seen("abc") {
+		t.Fatal("added id should be known")
+	}
+	_ = j.Close()
+
+	// ids survive a restart
+	j = NewJournal(journalPath)
+	if err := j.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if !j.Seen("abc") {
+		t.Fatal("id should be loaded from disk")
+	}
+	_ = j.Close()
+}
+
+func TestJournal_Retention(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	journalPath := path.Join(tempPath, "journal")
+
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	recent := time.Now().Unix()
+	content := []byte(
+		strconv.FormatInt(old, 10) + " old\n" +
+			strconv.FormatInt(recent, 10) + " recent\n" +
+			"incomplete")
+
+	if err := ioutil.WriteFile(journalPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j := NewJournal(journalPath)
+	j.Retention = time.Hour
+	if err := j.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = j.Close()
+	}()
+
+	if j.Seen("old") {
+		t.Fatal("expired id should be dropped")
+	}
+	if !j.Seen("recent") {
+		t.Fatal("recent id should be kept")
+	}
+
+	data, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != strconv.FormatInt(recent, 10)+" recent\n" {
+		t.Fatalf("journal should be compacted, found: %q", data)
+	}
+}
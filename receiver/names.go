@@ -0,0 +1,52 @@
+package receiver
+
+import (
+	"github.com/lazyfrosch/filespooler/sender"
+	"strings"
+)
+
+const (
+	// MaxNameLength limits the full name of a file including its relative path
+	MaxNameLength = 4096
+	// MaxNameComponentLength limits every part of the path, like most filesystems do
+	MaxNameComponentLength = 255
+)
+
+// ValidateName checks a file name sent by a peer, before it is used as a path below the target.
+//
+// Separators are only allowed when recursive mode has been agreed on.
+func ValidateName(name string, recursive bool) error {
+	switch {
+	case name == "":
+		return rejectName(name, "name is empty")
+	case len(name) > MaxNameLength:
+		return rejectName(name, "name is longer than %d bytes", MaxNameLength)
+	case strings.ContainsRune(name, 0):
+		return rejectName(name, "name contains NUL")
+	case strings.ContainsRune(name, '\\'):
+		return rejectName(name, "name contains a backslash")
+	case strings.HasPrefix(name, "/"):
+		return rejectName(name, "name is an absolute path")
+	case !recursive && strings.ContainsRune(name, '/'):
+		return rejectName(name, "name contains a separator, but recursive mode is not enabled")
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		switch {
+		case part == "":
+			return rejectName(name, "name contains an empty path element")
+		case part == "." || part == "..":
+			return rejectName(name, "name contains a relative path element")
+		case len(part) > MaxNameComponentLength:
+			return rejectName(name, "path element is longer than %d bytes", MaxNameComponentLength)
+		case strings.HasPrefix(part, TempFilePrefix):
+			return rejectName(name, "name uses the reserved prefix %s", TempFilePrefix)
+		}
+	}
+
+	return nil
+}
+
+func rejectName(name string, format string, a ...interface{}) error {
+	return sender.NewResponseError(sender.ErrorNameRejected, "%q rejected: "+format, append([]interface{}{name}, a...)...)
+}
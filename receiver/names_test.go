@@ -0,0 +1,56 @@
+package receiver
+
+import (
+	"github.com/lazyfrosch/filespooler/sender"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	valid := []string{"spool-1", "file.txt", "..hidden", "a..b"}
+	validRecursive := []string{"host1/spool-1", "host1/2019/spool-2"}
+
+	invalid := []string{
+		"",
+		"..",
+		".",
+		"../../etc/cron.d/x",
+		"/etc/passwd",
+		"host1/spool-1",
+		"nul\x00byte",
+		"back\\slash",
+		TempFilePrefix + "abc",
+		strings.Repeat("a", MaxNameComponentLength+1),
+	}
+	invalidRecursive := []string{
+		"host1/../../etc/passwd",
+		"host1//spool-1",
+		"host1/",
+		"./spool-1",
+		"host1/" + TempFilePrefix + "abc",
+		strings.Repeat("a/", MaxNameLength/2) + "a",
+	}
+
+	for _, name := range append(valid, validRecursive...) {
+		if err := ValidateName(name, true); err != nil {
+			t.Fatalf("%q should be valid: %s", name, err)
+		}
+	}
+	for _, name := range valid {
+		if err := ValidateName(name, false); err != nil {
+			t.Fatalf("%q should be valid: %s", name, err)
+		}
+	}
+
+	for _, name := range invalid {
+		err := ValidateName(name, false)
+		if e, ok := err.(*sender.ResponseError); !ok || e.Class != sender.ErrorNameRejected {
+			t.Fatalf("%q should be rejected, got: %v", name, err)
+		}
+	}
+	for _, name := range invalidRecursive {
+		if err := ValidateName(name, true); err == nil {
+			t.Fatalf("%q should be rejected in recursive mode", name)
+		}
+	}
+}
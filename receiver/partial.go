@@ -0,0 +1,365 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"fmt"
+	"github.com/lazyfrosch/filespooler/sender"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartialStateSuffix is added to the name of a partial transfer, for the checksum state of the received bytes
+const PartialStateSuffix = ".hash"
+
+// PartialExpireInterval is the time between checks for expired partial transfers, while the receiver runs
+const PartialExpireInterval = 10 * time.Minute
+
+// PartialCheckpoint is the number of bytes received between saving the checksum state of a partial transfer
+const PartialCheckpoint = 64 << 20
+
+// partialLocks makes sure only one connection writes to a partial transfer, a sender might reconnect
+// before the receiver noticed that the old connection is gone
+type partialLocks struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newPartialLocks() *partialLocks {
+	return &partialLocks{active: make(map[string]bool)}
+}
+
+func (l *partialLocks) lock(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[id] {
+		return false
+	}
+	l.active[id] = true
+	return true
+}
+
+func (l *partialLocks) unlock(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.active, id)
+}
+
+func (l *partialLocks) isLocked(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active[id]
+}
+
+func (w FileWriter) partialPath(id string) string {
+	return path.Join(w.Path, PartialDir, id)
+}
+
+// loadState returns the checksum over the first bytes of a partial transfer, and how many bytes it covers.
+//
+// Without a usable state the transfer starts over, the bytes received so far would have to be hashed again.
+func (w FileWriter) loadState(id string, algorithm string) (hash.Hash, int64) {
+	h, err := sender.NewChecksum(algorithm)
+	if err != nil {
+		return nil, 0
+	}
+
+	content, err := ioutil.ReadFile(w.partialPath(id) + PartialStateSuffix)
+	if err != nil {
+		return h, 0
+	}
+
+	parts := strings.SplitN(string(content), "\n", 3)
+	if len(parts) != 3 || parts[0] != algorithm {
+		return h, 0
+	}
+
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || offset < 0 {
+		return h, 0
+	}
+
+	state, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok || state.UnmarshalBinary([]byte(parts[2])) != nil {
+		h.Reset()
+		return h, 0
+	}
+
+	return h, offset
+}
+
+// saveState keeps the checksum over the first offset bytes of a partial transfer, which must be synced already.
+//
+// The state is written to a temp file first, so it never covers more than the partial transfer.
+func (w FileWriter) saveState(id string, algorithm string, h hash.Hash, offset int64) error {
+	marshaler, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return fmt.Errorf("state of checksum %s can not be saved", algorithm)
+	}
+
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	statePath := w.partialPath(id) + PartialStateSuffix
+	content := append([]byte(algorithm+"\n"+strconv.FormatInt(offset, 10)+"\n"), state...)
+
+	if err := ioutil.WriteFile(statePath+".tmp", content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+// removePartial removes a partial transfer and its checksum state
+func (w FileWriter) removePartial(id string) {
+	_ = os.Remove(w.partialPath(id))
+	_ = os.Remove(w.partialPath(id) + PartialStateSuffix)
+}
+
+// checkpointWriter writes a partial transfer and its checksum, and saves the state of the checksum regularly
+type checkpointWriter struct {
+	w          FileWriter
+	f          *sender.FileData
+	fh         *os.File
+	h          hash.Hash
+	offset     int64
+	checkpoint int64
+}
+
+func (c *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := c.fh.Write(p)
+	_, _ = c.h.Write(p[:n])
+	c.offset += int64(n)
+
+	if err == nil && c.offset-c.checkpoint >= PartialCheckpoint {
+		err = c.save()
+	}
+
+	return n, err
+}
+
+// save syncs the received content and keeps the checksum state for resuming
+func (c *checkpointWriter) save() error {
+	if err := c.fh.Sync(); err != nil {
+		return err
+	}
+
+	if err := c.w.saveState(c.f.TransferId(), c.f.ChecksumType(), c.h, c.offset); err != nil {
+		return err
+	}
+
+	c.checkpoint = c.offset
+
+	return nil
+}
+
+// PartialSize returns how many bytes of a transfer have been received before, so the sender can resume
+func (w FileWriter) PartialSize(id string) (int64, error) {
+	if !sender.ValidTransferId(id) {
+		return 0, fmt.Errorf("invalid transfer id: %s", id)
+	}
+
+	if w.partials.isLocked(id) {
+		return 0, fmt.Errorf("transfer %s is still in progress", id)
+	}
+
+	info, err := os.Stat(w.partialPath(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if time.Since(info.ModTime()) > w.PartialExpire {
+		return 0, nil
+	}
+
+	// only bytes covered by the saved checksum state can be resumed
+	_, offset := w.loadState(id, stateAlgorithm(w.partialPath(id)+PartialStateSuffix))
+	if offset > info.Size() {
+		return 0, nil
+	}
+
+	return offset, nil
+}
+
+// stateAlgorithm reads the name of the checksum from a state file
+func stateAlgorithm(statePath string) string {
+	fh, err := os.Open(statePath)
+	if err != nil {
+		return ""
+	}
+
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	line, _ := bufio.NewReader(fh).ReadString('\n')
+	return strings.TrimSuffix(line, "\n")
+}
+
+// ExpirePartials removes interrupted transfers that have not been resumed within PartialExpire
+func (w FileWriter) ExpirePartials() error {
+	dir := path.Join(w.Path, PartialDir)
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read partial transfers: %s", err)
+	}
+
+	for _, file := range files {
+		id := strings.TrimSuffix(strings.TrimSuffix(file.Name(), ".tmp"), PartialStateSuffix)
+		if time.Since(file.ModTime()) <= w.PartialExpire || w.partials.isLocked(id) {
+			continue
+		}
+
+		log.Printf("Removing expired partial transfer %s", file.Name())
+
+		if err := os.Remove(path.Join(dir, file.Name())); err != nil {
+			return fmt.Errorf("could not remove partial transfer: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// RunExpirePartials removes expired partial transfers every interval until quit is closed
+func (w FileWriter) RunExpirePartials(interval time.Duration, quit <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := w.ExpirePartials(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// writePartial continues a transfer at f.Offset(), content is kept when the transfer is interrupted.
+//
+// The checksum is calculated while receiving, continuing from the state saved for the bytes received before.
+// Once complete, the file is verified against the checksum and renamed into place.
+func (w FileWriter) writePartial(f *sender.FileData, filePath string, content io.Reader) error {
+	id := f.TransferId()
+
+	if !sender.ValidTransferId(id) {
+		return fmt.Errorf("invalid transfer id: %s", id)
+	}
+	if f.ChecksumType() == "" {
+		return fmt.Errorf("resuming %s needs a checksum", f.Name())
+	}
+
+	if !w.partials.lock(id) {
+		return fmt.Errorf("transfer %s is still in progress", id)
+	}
+	defer w.partials.unlock(id)
+
+	if err := os.MkdirAll(path.Join(w.Path, PartialDir), 0700); err != nil {
+		return err
+	}
+
+	partialPath := w.partialPath(id)
+
+	fh, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = w.appendPartial(fh, f, content)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.rename(f, partialPath, filePath)
+}
+
+// appendPartial writes content at f.Offset() and verifies the complete file
+func (w FileWriter) appendPartial(fh *os.File, f *sender.FileData, content io.Reader) error {
+	id := f.TransferId()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	h, offset := w.loadState(id, f.ChecksumType())
+	if h == nil {
+		return fmt.Errorf("unsupported checksum algorithm: %s", f.ChecksumType())
+	}
+
+	if f.Offset() != 0 && (f.Offset() != offset || info.Size() < offset) {
+		w.removePartial(id)
+		return fmt.Errorf("partial transfer of %s has %d bytes, can not resume at %d", f.Name(), offset, f.Offset())
+	} else if f.Offset() == 0 {
+		h.Reset()
+	}
+
+	if err := fh.Truncate(f.Offset()); err != nil {
+		return err
+	}
+	if _, err := fh.Seek(f.Offset(), io.SeekStart); err != nil {
+		return err
+	}
+
+	out := &checkpointWriter{w: w, f: f, fh: fh, h: h, offset: f.Offset(), checkpoint: f.Offset()}
+
+	written, err := io.Copy(out, content)
+	if err == nil && written != f.Remaining() {
+		err = fmt.Errorf("received %d bytes for %s, expected %d", f.Offset()+written, f.Name(), f.Size())
+	}
+	if err != nil {
+		// keep what has been received, so the sender can resume
+		if saveErr := out.save(); saveErr != nil {
+			log.Printf("could not save state of partial transfer %s: %s", id, saveErr)
+		}
+		return err
+	}
+
+	if err := w.finishPartial(fh, f, h); err != nil {
+		// start over with the next attempt
+		w.removePartial(id)
+		return err
+	}
+
+	_ = os.Remove(w.partialPath(id) + PartialStateSuffix)
+
+	return nil
+}
+
+// finishPartial verifies the complete content and applies the attributes
+func (w FileWriter) finishPartial(fh *os.File, f *sender.FileData, h hash.Hash) error {
+	if sum := h.Sum(nil); !bytes.Equal(sum, f.Checksum()) {
+		return &ChecksumError{Name: f.Name(), Expected: f.Checksum(), Actual: sum}
+	}
+
+	if err := w.setAttributes(fh, f); err != nil {
+		return err
+	}
+
+	return fh.Sync()
+}
@@ -0,0 +1,210 @@
+package receiver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/lazyfrosch/filespooler/sender"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileWriter_Resume(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.PartialExpire = time.Hour
+
+	content := []byte("abcdefghijklmnopqrstuvwxyz")
+	sum := sha256.Sum256(content)
+
+	data := sender.NewFileData("resumed")
+	data.SetSize(int64(len(content)))
+	data.SetChecksum("sha256", sum[:])
+	data.SetTransferId(sender.NewTransferId(data))
+
+	// connection lost after 10 bytes
+	if err := w.WriteFile(data, bytes.NewReader(content[:10])); err == nil {
+		t.Fatal("interrupted transfer should fail")
+	}
+
+	if _, err := os.Stat(path.Join(tempPath, "resumed")); !os.IsNotExist(err) {
+		t.Fatal("interrupted transfer should not be visible")
+	}
+
+	offset, err := w.PartialSize(data.TransferId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 10 {
+		t.Fatalf("expected 10 bytes to resume from, got %d", offset)
+	}
+
+	data.SetOffset(offset)
+	if err := w.WriteFile(data, bytes.NewReader(content[offset:])); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ioutil.ReadFile(path.Join(tempPath, "resumed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, content) {
+		t.Fatalf("resumed file has unexpected content: %s", result)
+	}
+
+	if offset, _ := w.PartialSize(data.TransferId()); offset != 0 {
+		t.Fatal("partial transfer should be gone after completion")
+	}
+}
+
+func TestFileWriter_ResumeChecksum(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.PartialExpire = time.Hour
+
+	content := []byte("abcdefghijklmnopqrstuvwxyz")
+	sum := sha256.Sum256(content)
+
+	data := sender.NewFileData("corrupt")
+	data.SetSize(int64(len(content)))
+	data.SetChecksum("sha256", sum[:])
+	data.SetTransferId(sender.NewTransferId(data))
+
+	_ = w.WriteFile(data, bytes.NewReader([]byte("ABCDEFGHIJ")))
+
+	data.SetOffset(10)
+	err = w.WriteFile(data, bytes.NewReader(content[10:]))
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Fatalf("Expected a ChecksumError, got: %v", err)
+	}
+
+	if offset, _ := w.PartialSize(data.TransferId()); offset != 0 {
+		t.Fatal("corrupt partial transfer should be removed")
+	}
+}
+
+func TestFileWriter_ResumeWithoutState(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.PartialExpire = time.Hour
+
+	content := []byte("abcdefghijklmnopqrstuvwxyz")
+	sum := sha256.Sum256(content)
+
+	data := sender.NewFileData("crashed")
+	data.SetSize(int64(len(content)))
+	data.SetChecksum("sha256", sum[:])
+	data.SetTransferId(sender.NewTransferId(data))
+
+	_ = w.WriteFile(data, bytes.NewReader(content[:10]))
+
+	// receiver crashed before the checksum state was saved
+	if err := os.Remove(w.partialPath(data.TransferId()) + PartialStateSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset, _ := w.PartialSize(data.TransferId()); offset != 0 {
+		t.Fatalf("transfer without checksum state should start over, got offset %d", offset)
+	}
+
+	if err := w.WriteFile(data, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(w.partialPath(data.TransferId()) + PartialStateSuffix); !os.IsNotExist(err) {
+		t.Fatal("checksum state should be removed after completion")
+	}
+}
+
+func TestFileWriter_ExpirePartials(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.PartialExpire = time.Hour
+
+	id := sender.NewTransferId(sender.NewFileData("old"))
+	partialPath := w.partialPath(id)
+
+	_ = os.MkdirAll(path.Dir(partialPath), 0700)
+	if err := ioutil.WriteFile(partialPath, []byte("abc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileWriter(tempPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partialPath); err != nil {
+		t.Fatal("partial transfers should survive a restart")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(partialPath, old, old)
+
+	if err := w.ExpirePartials(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Fatal("expired partial transfer should be removed")
+	}
+
+	if _, err := w.PartialSize("../../etc/passwd"); err == nil {
+		t.Fatal("invalid transfer ids should be refused")
+	}
+}
+
+func TestFileWriter_RunExpirePartials(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.PartialExpire = time.Hour
+
+	quit := make(chan bool)
+	defer close(quit)
+
+	go w.RunExpirePartials(10*time.Millisecond, quit)
+
+	id := sender.NewTransferId(sender.NewFileData("old"))
+	partialPath := w.partialPath(id)
+
+	_ = os.MkdirAll(path.Dir(partialPath), 0700)
+	if err := ioutil.WriteFile(partialPath, []byte("abc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(partialPath, old, old)
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(partialPath); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("expired partial transfer should be removed while running")
+}
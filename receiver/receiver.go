@@ -7,8 +7,11 @@ import (
 	"github.com/lazyfrosch/filespooler/sender"
 	"github.com/lazyfrosch/filespooler/util"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +22,26 @@ const (
 	CommunicationTimeout = 60
 )
 
+// Placeholders for Receiver.Route
+const (
+	// RouteCert is replaced by the name on the client certificate
+	RouteCert = "{cert}"
+	// RouteIdentity is replaced by the identity the sender announced in HELLO
+	RouteIdentity = "{identity}"
+	// RouteDate is replaced by the current date, like 2019-01-02
+	RouteDate = "{date}"
+)
+
+// session holds the state of a connection after the handshake
+type session struct {
+	// peer is the HELLO as announced by the sender
+	peer *sender.Hello
+	// agreed is the protocol version and capabilities both sides support
+	agreed *sender.Hello
+	// certName is the name on the client certificate that matched PeerNames, empty without TLS
+	certName string
+}
+
 type Receiver struct {
 	bind      string
 	listener  *net.TCPListener
@@ -28,6 +51,15 @@ type Receiver struct {
 	exited    chan bool
 	TlsConfig *tls.Config
 	PeerNames []string
+	// Identity is announced to senders during the handshake
+	Identity string
+	// Recursive allows senders to recreate subdirectories below the target
+	Recursive bool
+	// Route is a template for the subdirectory files of a sender are written to, empty writes all files to the target.
+	// See RouteCert, RouteIdentity and RouteDate for the placeholders.
+	Route string
+	// Journal enables duplicate detection, files with a known delivery id are acknowledged but not written again
+	Journal *Journal
 }
 
 func NewReceiver(bind string, writer *FileWriter) *Receiver {
@@ -85,6 +117,7 @@ func (r *Receiver) Serve() {
 			}
 
 			var tlsConn *tls.Conn
+			var certName string
 			if r.TlsConfig != nil {
 				remote := conn.RemoteAddr().String()
 				err := conn.SetReadDeadline(time.Now().Add(ReadTimeout * time.Second))
@@ -109,6 +142,7 @@ func (r *Receiver) Serve() {
 
 					if ok, name := util.ValidateNamesOnCertificate(clientCert, r.PeerNames); ok {
 						log.Printf("[%s] client cert accepted with name %s", remote, name)
+						certName = name
 					} else {
 						log.Printf("[%s] client cert names did not match whitelist: %s", remote, r.PeerNames)
 						_ = conn.Close()
@@ -120,9 +154,9 @@ func (r *Receiver) Serve() {
 			handlers.Add(1)
 			go func() {
 				if tlsConn != nil {
-					r.handleConnection(tlsConn)
+					r.handleConnection(tlsConn, certName)
 				} else {
-					r.handleConnection(conn)
+					r.handleConnection(conn, certName)
 				}
 				handlers.Done()
 			}()
@@ -130,7 +164,8 @@ func (r *Receiver) Serve() {
 	}
 }
 
-func (r *Receiver) handleConnection(conn net.Conn) {
+// handleConnection reads commands from a sender, certName is the name the sender authenticated with
+func (r *Receiver) handleConnection(conn net.Conn, certName string) {
 	remote := conn.RemoteAddr()
 	log.Printf("[%s] accepted new connection", remote)
 
@@ -144,6 +179,9 @@ func (r *Receiver) handleConnection(conn net.Conn) {
 
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
+	// set by HELLO
+	var sess *session
+
 	for {
 		select {
 		case <-r.quit:
@@ -174,17 +212,48 @@ func (r *Receiver) handleConnection(conn net.Conn) {
 				return
 			}
 			cmd = strings.Trim(cmd, "\n ")
-			switch cmd {
+			parts := strings.SplitN(cmd, " ", 2)
+			name := parts[0]
+
+			if sess == nil && name != "HELLO" {
+				log.Printf("[%s] Peer did not start with HELLO, sent: %s", remote, cmd)
+				_ = r.writeResponse(rw, sender.NewResponseError(sender.ErrorProtocol, "handshake required, send HELLO first").String())
+				return
+			}
+
+			switch name {
+			case "HELLO":
+				if sess, err = r.handleHello(conn, rw, cmd, certName); err != nil {
+					log.Print(err)
+					return
+				}
 			case "SEND_FILE":
-				err := r.handleSendFile(conn, rw)
+				var id string
+				if len(parts) > 1 {
+					id = parts[1]
+				}
+
+				err := r.handleSendFile(conn, rw, sess, id)
 				if err != nil {
 					log.Print(err)
 					return
 				}
+				// a transfer counts as activity, content might take longer than the timeout
+				resetTimer(timer, CommunicationTimeout*time.Second)
+			case "RESUME":
+				var id string
+				if len(parts) > 1 {
+					id = parts[1]
+				}
+
+				if err := r.handleResume(conn, rw, sess, id); err != nil {
+					log.Print(err)
+					return
+				}
 			case "NOOP":
 			case "KEEPALIVE":
 				// resetting timeout
-				timer.Reset(CommunicationTimeout * time.Second)
+				resetTimer(timer, CommunicationTimeout*time.Second)
 			default:
 				log.Printf("[%s] Unknown command: %s", remote, cmd)
 			}
@@ -192,27 +261,283 @@ func (r *Receiver) handleConnection(conn net.Conn) {
 	}
 }
 
-func (r *Receiver) handleSendFile(conn net.Conn, rw *bufio.ReadWriter) error {
+func (r *Receiver) capabilities() []string {
+	var capabilities []string
+
+	for _, algorithm := range sender.ChecksumAlgorithms() {
+		capabilities = append(capabilities, sender.CapabilityChecksum+algorithm)
+	}
+
+	for _, algorithm := range sender.CompressionAlgorithms() {
+		capabilities = append(capabilities, sender.CapabilityCompression+algorithm)
+	}
+
+	if r.Recursive {
+		capabilities = append(capabilities, sender.CapabilityRecursive)
+	}
+
+	if r.Journal != nil {
+		capabilities = append(capabilities, sender.CapabilityDedup)
+	}
+
+	if r.writer.PartialExpire > 0 {
+		capabilities = append(capabilities, sender.CapabilityResume)
+	}
+
+	capabilities = append(capabilities, sender.CapabilityWindow)
+
+	return capabilities
+}
+
+// handleHello answers the handshake of the peer with the protocol version and capabilities both sides agree to
+func (r *Receiver) handleHello(conn net.Conn, rw *bufio.ReadWriter, cmd string, certName string) (*session, error) {
+	remote := conn.RemoteAddr()
+
+	peer, err := sender.ParseHello(cmd)
+	if err != nil {
+		_ = r.writeResponse(rw, sender.NewResponseError(sender.ErrorProtocol, "%s", err).String())
+		return nil, fmt.Errorf("[%s] %s", remote, err)
+	}
+
+	sess := &session{peer: peer, certName: certName}
+
+	sess.agreed, err = sender.NewHello(r.Identity, r.capabilities()).Agree(peer)
+	if err == nil {
+		// make sure files of this sender can be placed, before it starts sending
+		_, err = r.routeDir(sess, time.Now())
+	}
+	if err != nil {
+		_ = r.writeResponse(rw, sender.NewResponseError(sender.ErrorProtocol, "%s", err).String())
+		return nil, fmt.Errorf("[%s] refusing peer %s: %s", remote, peer.Identity, err)
+	}
+
+	log.Printf("[%s] peer %s speaks protocol version %d, agreed on: %s",
+		remote, peer.Identity, sess.agreed.Version, strings.Join(sess.agreed.Capabilities, ","))
+
+	if err := r.writeResponse(rw, sess.agreed.String()); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// routeDir returns the subdirectory below the target for files of a sender, empty for the target itself.
+//
+// Files are placed by Route, and with CollisionSender in a subdirectory named by the identity of the sender.
+func (r *Receiver) routeDir(sess *session, now time.Time) (string, error) {
+	var dir string
+
+	if r.Route != "" {
+		values := []string{
+			RouteCert, sess.certName,
+			RouteIdentity, sess.peer.Identity,
+			RouteDate, now.Format("2006-01-02"),
+		}
+
+		for i := 0; i < len(values); i += 2 {
+			// every value must be a single directory
+			if strings.Contains(r.Route, values[i]) {
+				if err := ValidateName(values[i+1], false); err != nil {
+					return "", fmt.Errorf("can not route files of %s by %s: %s", sess.peer.Identity, values[i], err)
+				}
+			}
+		}
+
+		dir = strings.NewReplacer(values...).Replace(r.Route)
+
+		if err := ValidateName(dir, true); err != nil {
+			return "", fmt.Errorf("can not route files of %s: %s", sess.peer.Identity, err)
+		}
+	}
+
+	if r.writer.Collision == CollisionSender {
+		if err := ValidateName(sess.peer.Identity, false); err != nil {
+			return "", fmt.Errorf("identity can not be used as a directory: %s", err)
+		}
+
+		dir = path.Join(dir, sess.peer.Identity)
+	}
+
+	return dir, nil
+}
+
+// handleSendFile receives a file and writes the response, id is only set when the window has been agreed on
+func (r *Receiver) handleSendFile(conn net.Conn, rw *bufio.ReadWriter, sess *session, id string) error {
 	remote := conn.RemoteAddr()
+
+	var ackId uint64
+	if sess.agreed.Has(sender.CapabilityWindow) {
+		var err error
+		if ackId, err = strconv.ParseUint(id, 10, 64); err != nil || ackId == 0 {
+			return fmt.Errorf("[%s] Invalid id for SEND_FILE: %s", remote, id)
+		}
+	}
+
 	file, err := sender.DecodeGobFileData(rw)
 	if err != nil {
 		return fmt.Errorf("[%s] Could not decode file: %s", remote, err)
 	}
 
-	log.Printf("[%s] Received file %s", remote, file.Name())
+	if file.Offset() > 0 {
+		log.Printf("[%s] Resuming file %s at %d of %d bytes", remote, file.Name(), file.Offset(), file.Size())
+	} else {
+		log.Printf("[%s] Receiving file %s (%d bytes)", remote, file.Name(), file.Size())
+	}
+
+	if !validOffset(file, sess) {
+		// the content that follows can not be handled
+		_ = r.writeFileResponse(rw, ackId, sender.NewResponseError(sender.ErrorProtocol,
+			"invalid offset %d for %s", file.Offset(), file.Name()).String())
+		return fmt.Errorf("[%s] Peer sent %s with an invalid offset", remote, file.Name())
+	}
+
+	var body io.Reader = &util.DeadlineReader{
+		Reader:  rw,
+		Conn:    conn,
+		Timeout: ReadTimeout * time.Second,
+	}
+
+	if file.Compression() == "" {
+		body = io.LimitReader(body, file.Remaining())
+	} else if sess.agreed.Has(sender.CapabilityCompression + file.Compression()) {
+		body = sender.NewChunkReader(body)
+	} else {
+		// the end of the content is unknown, the stream can not be kept in sync
+		_ = r.writeFileResponse(rw, ackId, sender.NewResponseError(sender.ErrorProtocol,
+			"compression %s has not been agreed on", file.Compression()).String())
+		return fmt.Errorf("[%s] Peer sent %s with unexpected compression %s", remote, file.Name(), file.Compression())
+	}
+
+	duplicate := r.isDuplicate(sess, file)
+
+	err = ValidateName(file.Name(), sess.agreed.Has(sender.CapabilityRecursive))
+	if err == nil {
+		var dir string
+		if dir, err = r.routeDir(sess, time.Now()); err == nil {
+			file.SetName(path.Join(dir, file.Name()))
+		}
+	}
+	if err == nil && !duplicate {
+		// nothing is written when the file would be rejected anyway
+		err = r.writer.CheckCollision(file.Name())
+	}
+	if err == nil && !duplicate {
+		err = r.receiveContent(file, body)
+	}
+
+	// consume what is left of the content, so the stream stays in sync
+	if _, drainErr := io.Copy(ioutil.Discard, body); drainErr != nil {
+		return fmt.Errorf("[%s] Could not read content for %s: %s", remote, file.Name(), drainErr)
+	}
 
-	err = r.writer.WriteFile(file)
 	if err != nil {
-		_, err = rw.WriteString("ERR\n")
-		if err != nil {
-			return fmt.Errorf("could not write ERR response: %s", err)
+		// the stream is still intact, report the error and continue with the next command
+		response := classifyError(err)
+		if response.Class == sender.ErrorNameRejected {
+			log.Printf("[%s] Rejected file from peer %s: %s", remote, sess.peer.Identity, response.Message)
+		} else {
+			log.Printf("[%s] Could not write file %s: %s", remote, file.Name(), response)
 		}
-		return fmt.Errorf("[%s] Could not write file: %s", remote, err)
+		return r.writeFileResponse(rw, ackId, response.String())
+	}
+
+	if duplicate {
+		log.Printf("[%s] Acknowledging duplicate of %s from peer %s", remote, file.Name(), sess.peer.Identity)
+		return r.writeFileResponse(rw, ackId, "OK")
+	}
+
+	if sess.agreed.Has(sender.CapabilityDedup) && file.DeliveryId() != "" {
+		if err := r.Journal.Add(file.DeliveryId()); err != nil {
+			// the file has been written, it might only be delivered twice
+			log.Printf("[%s] Could not record delivery of %s: %s", remote, file.Name(), err)
+		}
+	}
+
+	log.Printf("[%s] Received file %s", remote, file.Name())
+
+	return r.writeFileResponse(rw, ackId, "OK")
+}
+
+// validOffset checks that a file only continues a transfer when resuming has been agreed on
+func validOffset(file *sender.FileData, sess *session) bool {
+	if file.Offset() < 0 || file.Remaining() < 0 {
+		return false
+	}
+
+	if file.TransferId() == "" {
+		return file.Offset() == 0
+	}
+
+	return sess.agreed.Has(sender.CapabilityResume)
+}
+
+// isDuplicate checks the journal for the delivery id of a file
+func (r *Receiver) isDuplicate(sess *session, file *sender.FileData) bool {
+	if !sess.agreed.Has(sender.CapabilityDedup) || file.DeliveryId() == "" {
+		return false
+	}
+
+	if !sender.ValidDeliveryId(file.DeliveryId()) {
+		// not recorded either, so the file is just delivered
+		file.SetDeliveryId("")
+		return false
 	}
 
-	_, err = rw.WriteString("OK\n")
+	return r.Journal.Seen(file.DeliveryId())
+}
+
+// handleResume answers with the number of bytes already received for a transfer
+func (r *Receiver) handleResume(conn net.Conn, rw *bufio.ReadWriter, sess *session, id string) error {
+	remote := conn.RemoteAddr()
+
+	if !sess.agreed.Has(sender.CapabilityResume) {
+		_ = r.writeResponse(rw, sender.NewResponseError(sender.ErrorProtocol, "resuming has not been agreed on").String())
+		return fmt.Errorf("[%s] Peer sent RESUME without agreeing on it", remote)
+	}
+
+	if err := r.writer.ExpirePartials(); err != nil {
+		log.Printf("[%s] %s", remote, err)
+	}
+
+	offset, err := r.writer.PartialSize(id)
+	if err != nil {
+		// the sender can still send the whole file
+		return r.writeResponse(rw, classifyError(err).String())
+	}
+
+	return r.writeResponse(rw, sender.FormatOffset(offset))
+}
+
+// receiveContent writes the content of a file, and decompresses it when needed
+func (r *Receiver) receiveContent(file *sender.FileData, body io.Reader) error {
+	if file.Compression() == "" {
+		return r.writer.WriteFile(file, body)
+	}
+
+	decompressed, err := sender.NewDecompressor(body, file.Compression())
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = decompressed.Close()
+	}()
+
+	return r.writer.WriteFile(file, io.LimitReader(decompressed, file.Remaining()))
+}
+
+// writeFileResponse answers SEND_FILE, with an ACK when the sender uses a window
+func (r *Receiver) writeFileResponse(rw *bufio.ReadWriter, id uint64, response string) error {
+	if id != 0 {
+		response = sender.FormatAck(id, response)
+	}
+	return r.writeResponse(rw, response)
+}
+
+func (r *Receiver) writeResponse(rw *bufio.ReadWriter, response string) error {
+	_, err := rw.WriteString(response + "\n")
 	if err != nil {
-		return fmt.Errorf("could not write OK response: %s", err)
+		return fmt.Errorf("could not write %s response: %s", response, err)
 	}
 
 	err = rw.Flush()
@@ -223,6 +548,17 @@ func (r *Receiver) handleSendFile(conn net.Conn, rw *bufio.ReadWriter) error {
 	return nil
 }
 
+// resetTimer restarts the timer and discards an expiry that has not been consumed yet
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
 func (r *Receiver) Close() {
 	if r.running == true {
 		log.Println("Stopping receiver")
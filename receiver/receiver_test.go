@@ -1,6 +1,16 @@
 package receiver
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/lazyfrosch/filespooler/sender"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -62,3 +72,519 @@ func TestMultipleAddresses(t *testing.T) {
 		r.Close()
 	}
 }
+
+// testTransfer sends files from a temp spool to a receiver and verifies that they arrived
+func testTransfer(t *testing.T, addr string, names []string, configure func(r *Receiver, reader *sender.FileReader, s *sender.Sender)) {
+	r := testBind(t, addr, true)
+	defer cleanupTempDir()
+
+	source, err := ioutil.TempDir("", "filespooler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(source)
+	}()
+
+	content := bytes.Repeat([]byte("THIS IS SOME DEMO CONTENT FOR A FILE\n"), 10000)
+	for _, name := range names {
+		data := content
+		if name == "empty" {
+			data = nil
+		}
+		filePath := path.Join(source, name)
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := sender.NewFileReader(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := sender.NewSender(addr, reader)
+	if configure != nil {
+		configure(r, reader, s)
+	}
+
+	go r.Serve()
+	defer r.Close()
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	if err := s.SendFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		written, err := ioutil.ReadFile(path.Join(r.writer.Path, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name == "empty" {
+			if len(written) != 0 {
+				t.Fatalf("%s should be empty", name)
+			}
+		} else if !bytes.Equal(content, written) {
+			t.Fatalf("content of %s does not match", name)
+		}
+
+		if _, err := os.Stat(path.Join(source, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been removed from source", name)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	testTransfer(t, "127.0.0.1:12347", []string{"spool-1", "spool-2", "empty"}, nil)
+}
+
+func TestTransferWithoutWindow(t *testing.T) {
+	names := []string{"spool-1", "spool-2", "spool-3"}
+
+	testTransfer(t, "127.0.0.1:12353", names, func(r *Receiver, reader *sender.FileReader, s *sender.Sender) {
+		s.Window = 1
+	})
+}
+
+func TestTransferBatches(t *testing.T) {
+	names := []string{"spool-1", "spool-2", "spool-3", "spool-4", "spool-5"}
+
+	testTransfer(t, "127.0.0.1:12352", names, func(r *Receiver, reader *sender.FileReader, s *sender.Sender) {
+		reader.BatchFiles = 2
+	})
+}
+
+func TestTransferWorkers(t *testing.T) {
+	var names []string
+	for i := 1; i <= 20; i++ {
+		names = append(names, fmt.Sprintf("spool-%d", i))
+	}
+
+	testTransfer(t, "127.0.0.1:12354", names, func(r *Receiver, reader *sender.FileReader, s *sender.Sender) {
+		reader.BatchFiles = 8
+		s.Window = 2
+		s.Workers = 3
+	})
+}
+
+func TestTransferCompressed(t *testing.T) {
+	names := []string{"spool-1", "spool-2.gz", "spool-3"}
+
+	testTransfer(t, "127.0.0.1:12355", names, func(r *Receiver, reader *sender.FileReader, s *sender.Sender) {
+		s.Compression = sender.CompressionGzip
+		s.Workers = 2
+	})
+}
+
+func TestTransferResume(t *testing.T) {
+	names := []string{"spool-1", "spool-2", "spool-3"}
+
+	testTransfer(t, "127.0.0.1:12356", names, func(r *Receiver, reader *sender.FileReader, s *sender.Sender) {
+		r.writer.PartialExpire = time.Hour
+		s.ResumeSize = 1
+		s.Compression = sender.CompressionGzip
+	})
+}
+
+func TestTransferRecursive(t *testing.T) {
+	names := []string{"spool-1", "host1/spool-2", "host2/2019/spool-3"}
+
+	testTransfer(t, "127.0.0.1:12349", names, func(r *Receiver, reader *sender.FileReader, s *sender.Sender) {
+		r.Recursive = true
+		reader.Recursive = true
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	r := testBind(t, "127.0.0.1:12348", true)
+	defer cleanupTempDir()
+
+	go r.Serve()
+	defer r.Close()
+
+	tests := map[string]string{
+		"SEND_FILE":                      "ERR protocol handshake required",
+		"HELLO 0 test -":                 "ERR protocol unsupported protocol version",
+		"HELLO 1 test checksum:sha256,x": "HELLO 1 ",
+	}
+
+	for cmd, expected := range tests {
+		conn, err := net.Dial("tcp", "127.0.0.1:12348")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		_, _ = rw.WriteString(cmd + "\n")
+		_ = rw.Flush()
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		response, err := rw.ReadString('\n')
+		_ = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(response, expected) {
+			t.Fatalf("unexpected response for %s: %s", cmd, response)
+		}
+
+		if expected == "HELLO 1 " && !strings.HasSuffix(response, " checksum:sha256\n") {
+			t.Fatalf("receiver should only agree to known capabilities: %s", response)
+		}
+	}
+}
+
+func TestTransferRecursiveRefused(t *testing.T) {
+	r := testBind(t, "127.0.0.1:12350", true)
+	defer cleanupTempDir()
+
+	go r.Serve()
+	defer r.Close()
+
+	reader, err := sender.NewFileReader(r.writer.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Recursive = true
+
+	s := sender.NewSender("127.0.0.1:12350", reader)
+	err = s.Open()
+	if err == nil || !strings.Contains(err.Error(), "does not support recursive") {
+		t.Fatalf("receiver without recursive mode should refuse, got: %v", err)
+	}
+}
+
+func TestRejectName(t *testing.T) {
+	r := testBind(t, "127.0.0.1:12351", true)
+	defer cleanupTempDir()
+
+	go r.Serve()
+	defer r.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:12351")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	_, _ = rw.WriteString(sender.NewHello("test", nil).String() + "\n")
+	_ = rw.Flush()
+	if _, err := rw.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../escape", "sub/file"} {
+		file := sender.NewFileData(name)
+		file.SetSize(4)
+
+		_, _ = rw.WriteString("SEND_FILE\n")
+		_ = gob.NewEncoder(rw).Encode(file)
+		_, _ = rw.WriteString("test")
+		_ = rw.Flush()
+
+		response, err := rw.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e, ok := sender.ParseResponse(response).(*sender.ResponseError); !ok || e.Class != sender.ErrorNameRejected {
+			t.Fatalf("%s should be rejected, got: %s", name, response)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(path.Dir(r.writer.Path), "escape")); !os.IsNotExist(err) {
+		t.Fatal("file should not be written outside of target")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	r := testBind(t, "127.0.0.1:12357", true)
+	defer cleanupTempDir()
+
+	journalPath := r.writer.Path + ".journal"
+	defer func() {
+		_ = os.Remove(journalPath)
+	}()
+
+	r.Journal = NewJournal(journalPath)
+	if err := r.Journal.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = r.Journal.Close()
+	}()
+
+	go r.Serve()
+	defer r.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:12357")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	_, _ = rw.WriteString(sender.NewHello("test", []string{sender.CapabilityDedup}).String() + "\n")
+	_ = rw.Flush()
+	if _, err := rw.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	file := sender.NewFileData("spool-1")
+	file.SetSize(4)
+	file.SetDeliveryId(sender.NewDeliveryId("test", file))
+
+	filePath := path.Join(r.writer.Path, "spool-1")
+
+	for i := 0; i < 2; i++ {
+		_, _ = rw.WriteString("SEND_FILE\n")
+		_ = gob.NewEncoder(rw).Encode(file)
+		_, _ = rw.WriteString("test")
+		_ = rw.Flush()
+
+		response, err := rw.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sender.ParseResponse(response); err != nil {
+			t.Fatalf("file should be acknowledged, got: %s", err)
+		}
+
+		if i == 0 {
+			// consumer picks up the file
+			if err := os.Remove(filePath); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatal("duplicate should not be delivered again")
+	}
+}
+
+func TestRouteDir(t *testing.T) {
+	r := NewReceiver("", &FileWriter{})
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	sess := &session{
+		peer:     sender.NewHello("sender1", nil),
+		certName: "host1.example.com",
+	}
+
+	tests := map[string]string{
+		"":                    "",
+		RouteCert:             "host1.example.com",
+		"in/" + RouteCert:     "in/host1.example.com",
+		RouteCert + "/{date}": "host1.example.com/2019-01-02",
+		RouteIdentity:         "sender1",
+	}
+
+	for route, expected := range tests {
+		r.Route = route
+
+		dir, err := r.routeDir(sess, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir != expected {
+			t.Errorf("route %q resulted in %q, expected %q", route, dir, expected)
+		}
+	}
+
+	r.Route = RouteCert
+	r.writer.Collision = CollisionSender
+	if dir, _ := r.routeDir(sess, now); dir != "host1.example.com/sender1" {
+		t.Errorf("files should be in a subdirectory per sender, got %q", dir)
+	}
+
+	for _, certName := range []string{"", "..", "a/b"} {
+		sess.certName = certName
+		if _, err := r.routeDir(sess, now); err == nil {
+			t.Errorf("certificate name %q should not be usable as directory", certName)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	addresses := []string{"127.0.0.1:12358", "127.0.0.1:12359"}
+
+	var receivers []*Receiver
+	for _, addr := range addresses {
+		r := testBind(t, addr, true)
+		defer func() {
+			_ = os.RemoveAll(r.writer.Path)
+		}()
+
+		go r.Serve()
+		defer r.Close()
+
+		receivers = append(receivers, r)
+	}
+
+	source, err := ioutil.TempDir("", "filespooler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(source)
+	}()
+
+	names := []string{"spool-1", "spool-2", "spool-3"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(path.Join(source, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := sender.NewFileReader(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send to one destination, every sender is started with progress loaded from disk like after a restart
+	send := func(i int) {
+		progress := sender.NewProgress(path.Join(source, sender.ProgressFile), len(addresses))
+		if err := progress.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = progress.Close()
+		}()
+
+		s := sender.NewSender(addresses[i], reader.Clone())
+		s.Progress = progress
+
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = s.Close()
+		}()
+
+		if err := s.SendFiles(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(0)
+
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(source, name)); err != nil {
+			t.Fatalf("%s should be kept until all destinations have it: %s", name, err)
+		}
+
+		// consumer picks up the file
+		if err := os.Remove(path.Join(receivers[0].writer.Path, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(0)
+
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(receivers[0].writer.Path, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not be sent to the same destination again", name)
+		}
+	}
+
+	send(1)
+
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(receivers[1].writer.Path, name)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(path.Join(source, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been removed from source", name)
+		}
+	}
+}
+
+func TestFanOutBatches(t *testing.T) {
+	r := testBind(t, "127.0.0.1:12360", true)
+	defer func() {
+		_ = os.RemoveAll(r.writer.Path)
+	}()
+
+	go r.Serve()
+	defer r.Close()
+
+	source, err := ioutil.TempDir("", "filespooler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(source)
+	}()
+
+	var names []string
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("spool-%d", i)
+		if err := ioutil.WriteFile(path.Join(source, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	reader, err := sender.NewFileReader(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.BatchFiles = 2
+
+	// the second destination is down, files stay in the spool
+	progress := sender.NewProgress(path.Join(source, sender.ProgressFile), 2)
+	if err := progress.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = progress.Close()
+	}()
+
+	s := sender.NewSender("127.0.0.1:12360", reader)
+	s.Progress = progress
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := s.SendFiles(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(r.writer.Path, name)); err != nil {
+			t.Fatalf("%s should have been sent past the batch limit: %s", name, err)
+		}
+		if _, err := os.Stat(path.Join(source, name)); err != nil {
+			t.Fatalf("%s should be kept for the other destination: %s", name, err)
+		}
+	}
+}
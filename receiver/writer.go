@@ -1,19 +1,90 @@
 package receiver
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/lazyfrosch/filespooler/sender"
+	"github.com/lazyfrosch/filespooler/util"
+	"hash"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/user"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ChecksumError is returned by FileWriter.WriteFile when the received content does not match the checksum
+type ChecksumError struct {
+	Name     string
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %x, got %x", e.Name, e.Expected, e.Actual)
+}
+
+// TempFilePrefix marks files that are still being received, they are hidden from consumers until renamed
+const TempFilePrefix = ".filespooler-"
+
+// PartialDir keeps interrupted transfers below the target, until the sender resumes them or they expire
+const PartialDir = TempFilePrefix + "partial"
+
+// DefaultPartialExpire is the default time an interrupted transfer is kept
+const DefaultPartialExpire = 24 * time.Hour
+
+// DefaultFileMode is used for written files, unless the mode of the sender is preserved
+const DefaultFileMode = 0644
+
+// Policies for the ownership of written files
+const (
+	// OwnerNone keeps the user the receiver runs as
+	OwnerNone = "none"
+	// OwnerId applies uid and gid of the sender
+	OwnerId = "id"
+	// OwnerName applies user and group names of the sender, and falls back to the ids when unknown locally
+	OwnerName = "name"
+)
+
+// Policies for files that already exist in the target
+const (
+	// CollisionOverwrite replaces the existing file
+	CollisionOverwrite = "overwrite"
+	// CollisionReject refuses the new file, the sender tries again later until it gives up on the file
+	CollisionReject = "reject"
+	// CollisionCounter adds a counter to the name of the new file, like "report.1.csv"
+	CollisionCounter = "counter"
+	// CollisionTimestamp adds the time of receiving to the name of the new file, like "report.20190102-150405.csv"
+	CollisionTimestamp = "timestamp"
+	// CollisionSender writes the files of every sender to a subdirectory named by its identity
+	CollisionSender = "sender"
+)
+
+// MaxCollisions limits the number of names tried for a file with CollisionCounter and CollisionTimestamp
+const MaxCollisions = 1000
+
 type FileWriter struct {
 	Path string
+	// PreserveModTime applies the modification time of the sender
+	PreserveModTime bool
+	// PreserveMode applies the permission bits of the sender instead of DefaultFileMode
+	PreserveMode bool
+	// Owner is the policy for file ownership, see OwnerNone, OwnerId and OwnerName
+	Owner string
+	// Collision is the policy for files that already exist, see CollisionOverwrite and the other Collision constants
+	Collision string
+	// PartialExpire is the time interrupted transfers are kept for resuming, 0 disables resuming
+	PartialExpire time.Duration
+	// transfers that are currently written to PartialDir
+	partials *partialLocks
 }
 
 func NewFileWriter(path string) (*FileWriter, error) {
-	w := FileWriter{Path: path}
+	w := FileWriter{Path: path, partials: newPartialLocks()}
 	err := w.init()
 	if err != nil {
 		return nil, err
@@ -38,10 +109,263 @@ func (w FileWriter) init() error {
 		return fmt.Errorf("target path %s exists and is not a directory", w.Path)
 	}
 
+	return w.cleanup()
+}
+
+// cleanup removes temp files that were left behind by an interrupted receiver, including subdirectories
+func (w FileWriter) cleanup() error {
+	return w.cleanupDir(w.Path)
+}
+
+func (w FileWriter) cleanupDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read target directory: %s", err)
+	}
+
+	for _, file := range files {
+		filePath := path.Join(dir, file.Name())
+
+		if file.IsDir() && filePath == path.Join(w.Path, PartialDir) {
+			// partial transfers are kept until they expire
+			continue
+		}
+
+		if file.IsDir() {
+			if err := w.cleanupDir(filePath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(file.Name(), TempFilePrefix) {
+			continue
+		}
+
+		log.Printf("Removing orphaned temp file %s", filePath)
+
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("could not remove orphaned temp file: %s", err)
+		}
+	}
+
 	return nil
 }
 
-func (w FileWriter) WriteFile(f *sender.FileData) error {
+// WriteFile streams the content of a file to disk, content must provide exactly f.Size() bytes
+//
+// Content is written to a hidden temp file first, which is synced and then renamed into place.
+// So consumers never see partial files. When the header carries a checksum, it is verified before the rename.
+func (w FileWriter) WriteFile(f *sender.FileData, content io.Reader) error {
+	// names are validated per session already, this makes sure nothing is ever written outside of Path
+	if err := ValidateName(f.Name(), true); err != nil {
+		return err
+	}
+
 	filePath := path.Join(w.Path, f.Name())
-	return ioutil.WriteFile(filePath, f.Content(), 0644)
+	dir := path.Dir(filePath)
+
+	if dir != path.Clean(w.Path) {
+		// file in a subdirectory, only possible in recursive mode
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if f.TransferId() != "" {
+		return w.writePartial(f, filePath, content)
+	}
+
+	fh, err := ioutil.TempFile(dir, TempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	tempPath := fh.Name()
+	defer func() {
+		// only exists when something failed before the rename
+		_ = os.Remove(tempPath)
+	}()
+
+	err = w.writeTemp(fh, f, content)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.rename(f, tempPath, filePath)
+}
+
+// rename moves a completely written file into place
+func (w FileWriter) rename(f *sender.FileData, tempPath, filePath string) error {
+	if w.PreserveModTime && !f.ModTime().IsZero() {
+		if err := os.Chtimes(tempPath, f.ModTime(), f.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	if err := w.place(tempPath, filePath); err != nil {
+		return err
+	}
+
+	return util.SyncDir(path.Dir(filePath))
+}
+
+// place moves a written file to its name in the target, according to the collision policy.
+//
+// Except for overwriting, the file is hard linked, which fails when the name already exists.
+func (w FileWriter) place(tempPath, filePath string) error {
+	switch w.Collision {
+	case CollisionReject:
+		return linkFile(tempPath, filePath)
+	case CollisionCounter, CollisionTimestamp:
+		for i := 0; i < MaxCollisions; i++ {
+			name := w.collisionName(filePath, i)
+
+			err := linkFile(tempPath, name)
+			if !os.IsExist(err) {
+				if err == nil && i > 0 {
+					log.Printf("File %s already exists, wrote %s", filePath, name)
+				}
+				return err
+			}
+		}
+
+		return fmt.Errorf("could not find a free name for %s after %d attempts", filePath, MaxCollisions)
+	default:
+		return os.Rename(tempPath, filePath)
+	}
+}
+
+// CheckCollision refuses a file before its content is received, when it already exists and CollisionReject is set
+func (w FileWriter) CheckCollision(name string) error {
+	if w.Collision != CollisionReject {
+		return nil
+	}
+
+	filePath := path.Join(w.Path, name)
+	if _, err := os.Lstat(filePath); err == nil {
+		return &os.PathError{Op: "create", Path: filePath, Err: os.ErrExist}
+	}
+
+	return nil
+}
+
+// collisionName returns the name for attempt i to place a file, the first attempt is the original name
+func (w FileWriter) collisionName(filePath string, i int) string {
+	if i == 0 {
+		return filePath
+	}
+
+	var suffix string
+	if w.Collision == CollisionTimestamp {
+		suffix = time.Now().Format("20060102-150405")
+		if i > 1 {
+			suffix += "-" + strconv.Itoa(i-1)
+		}
+	} else {
+		suffix = strconv.Itoa(i)
+	}
+
+	dir, name := path.Split(filePath)
+	ext := path.Ext(name)
+	if ext == name {
+		// dot file without extension
+		ext = ""
+	}
+
+	return dir + strings.TrimSuffix(name, ext) + "." + suffix + ext
+}
+
+// linkFile moves a file to a new name, which must not exist yet
+func linkFile(oldPath, newPath string) error {
+	if err := os.Link(oldPath, newPath); err != nil {
+		return err
+	}
+
+	return os.Remove(oldPath)
+}
+
+// setAttributes applies permission bits and ownership according to the policy
+func (w FileWriter) setAttributes(fh *os.File, f *sender.FileData) error {
+	mode := os.FileMode(DefaultFileMode)
+	if w.PreserveMode && f.Mode() != 0 {
+		mode = f.Mode().Perm()
+	}
+
+	if err := fh.Chmod(mode); err != nil {
+		return err
+	}
+
+	if w.Owner != "" && w.Owner != OwnerNone && f.Owner() != nil {
+		uid, gid := w.resolveOwner(f.Owner())
+		if err := fh.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w FileWriter) writeTemp(fh *os.File, f *sender.FileData, content io.Reader) error {
+	if err := w.setAttributes(fh, f); err != nil {
+		return err
+	}
+
+	var out io.Writer = fh
+	var h hash.Hash
+
+	if f.ChecksumType() != "" {
+		var err error
+		if h, err = sender.NewChecksum(f.ChecksumType()); err != nil {
+			return err
+		}
+		out = io.MultiWriter(fh, h)
+	}
+
+	written, err := io.Copy(out, content)
+	if err != nil {
+		return err
+	}
+
+	if written != f.Size() {
+		return fmt.Errorf("received %d bytes for %s, expected %d", written, f.Name(), f.Size())
+	}
+
+	if h != nil {
+		if sum := h.Sum(nil); !bytes.Equal(sum, f.Checksum()) {
+			return &ChecksumError{Name: f.Name(), Expected: f.Checksum(), Actual: sum}
+		}
+	}
+
+	return fh.Sync()
+}
+
+// resolveOwner returns the local uid and gid for the owner of a file on the sender
+func (w FileWriter) resolveOwner(owner *sender.FileOwner) (int, int) {
+	uid, gid := owner.Uid, owner.Gid
+
+	if w.Owner != OwnerName {
+		return uid, gid
+	}
+
+	if owner.User != "" {
+		if u, err := user.Lookup(owner.User); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+
+	if owner.Group != "" {
+		if g, err := user.LookupGroup(owner.Group); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+
+	return uid, gid
 }
@@ -2,11 +2,14 @@ package receiver
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"github.com/lazyfrosch/filespooler/sender"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 var tempPath string
@@ -45,11 +48,11 @@ func TestFileWriter(t *testing.T) {
 
 func testWrite(t *testing.T, w *FileWriter, tempPath string, name string, content []byte) {
 	data := sender.NewFileData(name)
-	data.SetContent(content)
+	data.SetSize(int64(len(content)))
 
 	filePath := path.Join(tempPath, name)
 
-	err := w.WriteFile(data)
+	err := w.WriteFile(data, bytes.NewReader(content))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,4 +66,234 @@ func testWrite(t *testing.T, w *FileWriter, tempPath string, name string, conten
 	if err != nil || bytes.Compare(content, writtenContent) != 0 {
 		t.Fatal("content is not identical")
 	}
+
+	info, err := os.Stat(filePath)
+	if err != nil || info.Mode().Perm() != 0644 {
+		t.Fatal("written file should have mode 0644")
+	}
+}
+
+func TestFileWriter_ShortContent(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := sender.NewFileData("short")
+	data.SetSize(10)
+
+	err = w.WriteFile(data, bytes.NewReader([]byte("abc")))
+	if err == nil {
+		t.Fatal("Writing less content than announced should fail")
+	}
+
+	files, err := ioutil.ReadDir(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("No files should be left after a failed write, found %d", len(files))
+	}
+}
+
+func TestFileWriter_Cleanup(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	orphan := path.Join(tempPath, TempFilePrefix+"123456")
+	if err := ioutil.WriteFile(orphan, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	other := path.Join(tempPath, ".other")
+	if err := ioutil.WriteFile(other, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("orphaned temp file should have been removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatal("other files should not be touched")
+	}
+}
+
+func TestFileWriter_Checksum(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("abcdef")
+	sum := sha256.Sum256(content)
+
+	data := sender.NewFileData("valid")
+	data.SetSize(int64(len(content)))
+	data.SetChecksum("sha256", sum[:])
+
+	if err := w.WriteFile(data, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	data = sender.NewFileData("invalid")
+	data.SetSize(int64(len(content)))
+	data.SetChecksum("sha256", sum[:])
+
+	err = w.WriteFile(data, bytes.NewReader([]byte("abcdeF")))
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Fatalf("Expected a ChecksumError, got: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(tempPath, "invalid")); !os.IsNotExist(err) {
+		t.Fatal("File with checksum mismatch should not be written")
+	}
+}
+
+func TestFileWriter_Metadata(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.PreserveModTime = true
+	w.PreserveMode = true
+	w.Owner = OwnerId
+
+	content := []byte("#!/bin/sh\n")
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+
+	data := sender.NewFileData("script")
+	data.SetSize(int64(len(content)))
+	data.RawModTime = mtime
+	data.RawMode = 0750
+	data.SetOwner(&sender.FileOwner{Uid: os.Getuid(), Gid: os.Getgid()})
+
+	if err := w.WriteFile(data, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path.Join(tempPath, "script"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0750 {
+		t.Fatalf("mode should be preserved, got %s", info.Mode())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("mtime should be preserved, got %s", info.ModTime())
+	}
+}
+
+func TestFileWriter_ResolveOwner(t *testing.T) {
+	owner := &sender.FileOwner{Uid: 1234, Gid: 5678, User: "root", Group: "doesnotexist-filespooler"}
+
+	w := FileWriter{Owner: OwnerId}
+	if uid, gid := w.resolveOwner(owner); uid != 1234 || gid != 5678 {
+		t.Fatalf("ids should be used as is, got %d:%d", uid, gid)
+	}
+
+	w.Owner = OwnerName
+	if uid, gid := w.resolveOwner(owner); uid != 0 || gid != 5678 {
+		t.Fatalf("names should be resolved with fallback to ids, got %d:%d", uid, gid)
+	}
+}
+
+func TestFileWriter_Collision(t *testing.T) {
+	tempPath := getTempDir(t)
+	defer cleanupTempDir()
+
+	w, err := NewFileWriter(tempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, content string) error {
+		data := sender.NewFileData(name)
+		data.SetSize(int64(len(content)))
+		return w.WriteFile(data, bytes.NewReader([]byte(content)))
+	}
+
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(path.Join(tempPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	_ = write("report.csv", "first")
+
+	w.Collision = CollisionReject
+	if err := write("report.csv", "second"); !os.IsExist(err) {
+		t.Fatalf("existing file should be rejected, got: %v", err)
+	}
+	if err := w.CheckCollision("report.csv"); !os.IsExist(err) {
+		t.Fatalf("existing file should be rejected before receiving content, got: %v", err)
+	}
+	if err := w.CheckCollision("other.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if read("report.csv") != "first" {
+		t.Fatal("rejected file should not change the existing one")
+	}
+
+	w.Collision = CollisionCounter
+	for _, content := range []string{"second", "third"} {
+		if err := write("report.csv", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if read("report.1.csv") != "second" || read("report.2.csv") != "third" {
+		t.Fatal("new files should get a counter")
+	}
+
+	w.Collision = CollisionOverwrite
+	if err := write("report.csv", "fourth"); err != nil {
+		t.Fatal(err)
+	}
+	if read("report.csv") != "fourth" {
+		t.Fatal("existing file should be overwritten")
+	}
+
+	files, _ := ioutil.ReadDir(tempPath)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files in target, found %d", len(files))
+	}
+}
+
+func TestFileWriter_CollisionName(t *testing.T) {
+	w := FileWriter{Collision: CollisionCounter}
+
+	tests := map[string]string{
+		"/target/report.csv":     "/target/report.2.csv",
+		"/target/sub/data":       "/target/sub/data.2",
+		"/target/.hidden":        "/target/.hidden.2",
+		"/target/archive.tar.gz": "/target/archive.tar.2.gz",
+	}
+
+	for name, expected := range tests {
+		if result := w.collisionName(name, 2); result != expected {
+			t.Errorf("collisionName(%s) = %s, expected %s", name, result, expected)
+		}
+	}
+
+	w.Collision = CollisionTimestamp
+	if result := w.collisionName("/target/report.csv", 1); !strings.HasPrefix(result, "/target/report.2") {
+		t.Errorf("expected a timestamp in %s", result)
+	}
 }
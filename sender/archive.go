@@ -0,0 +1,251 @@
+package sender
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ArchiveBuckets maps the names of date buckets in the archive to their layout
+var ArchiveBuckets = map[string]string{
+	"none":    "",
+	"monthly": "2006/01",
+	"daily":   "2006/01/02",
+	"hourly":  "2006/01/02/15",
+}
+
+// DefaultPruneInterval is the default time between checks of the archive for files to remove
+const DefaultPruneInterval = 10 * time.Minute
+
+// Done finishes a file after it has been acknowledged, it is moved to Archive, or deleted when no archive is set
+func (r FileReader) Done(name string) error {
+	if r.Archive == "" {
+		return r.Delete(name)
+	}
+
+	return r.archiveFile(name)
+}
+
+// ArchivePath returns the archive directory, a relative Archive is inside the spool
+func (r FileReader) ArchivePath() string {
+	if path.IsAbs(r.Archive) {
+		return path.Clean(r.Archive)
+	}
+	return path.Join(r.path, r.Archive)
+}
+
+// isArchive returns true for the directory of the archive, when it is inside the spool
+func (r FileReader) isArchive(relPath string) bool {
+	return r.Archive != "" && path.Join(r.path, relPath) == r.ArchivePath()
+}
+
+// archiveFile moves a file to the archive, into a bucket for the current time, keeping its relative path.
+//
+// The modification time is set to the time of archiving, so the retention of ArchivePruner starts then.
+func (r FileReader) archiveFile(name string) error {
+	now := time.Now()
+
+	dir := r.ArchivePath()
+	if r.ArchiveBucket != "" {
+		dir = path.Join(dir, now.Format(r.ArchiveBucket))
+	}
+
+	target := path.Join(dir, name)
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("could not create archive directory %s: %s", path.Dir(target), err)
+	}
+
+	// never replace an archived file with the same name
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = path.Join(dir, name+"."+strconv.Itoa(i))
+	}
+
+	filePath := path.Join(r.path, name)
+	if err := moveFile(filePath, target); err != nil {
+		return fmt.Errorf("could not move file %s to archive: %s", filePath, err)
+	}
+
+	if err := os.Chtimes(target, now, now); err != nil {
+		log.Printf("could not set time of archived file %s: %s", target, err)
+	}
+
+	r.removeMarker(name)
+
+	if r.Recursive {
+		r.pruneDirs(path.Dir(name))
+	}
+
+	return nil
+}
+
+// moveFile renames a file, and copies it when the target is on another filesystem
+func moveFile(oldPath, newPath string) error {
+	err := os.Rename(oldPath, newPath)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	if err := copyFile(oldPath, newPath); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+
+	return os.Remove(oldPath)
+}
+
+func copyFile(oldPath, newPath string) error {
+	in, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = in.Close()
+	}()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(newPath, info.ModTime(), info.ModTime())
+}
+
+// ArchivePruner removes files from the archive by age or total size.
+//
+// The age is taken from the modification time, which is set when a file is archived.
+type ArchivePruner struct {
+	path string
+	// MaxAge removes files modified longer ago, 0 keeps files regardless of their age
+	MaxAge time.Duration
+	// MaxBytes removes the oldest files until the archive is smaller, 0 is unlimited
+	MaxBytes int64
+	// Interval is the time between checks of the archive
+	Interval time.Duration
+}
+
+func NewArchivePruner(path string) *ArchivePruner {
+	return &ArchivePruner{
+		path:     path,
+		Interval: DefaultPruneInterval,
+	}
+}
+
+type archivedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Prune removes files that exceed the retention, and directories that are empty afterwards
+func (p *ArchivePruner) Prune() error {
+	var files []archivedFile
+	var total int64
+
+	err := filepath.Walk(p.path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, archivedFile{path: filePath, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not read archive: %s", err)
+	}
+
+	// oldest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	removed := 0
+
+	for _, file := range files {
+		expired := p.MaxAge > 0 && time.Since(file.modTime) > p.MaxAge
+		tooLarge := p.MaxBytes > 0 && total > p.MaxBytes
+
+		if !expired && !tooLarge {
+			break
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			return fmt.Errorf("could not remove archived file: %s", err)
+		}
+
+		total -= file.size
+		removed++
+
+		p.pruneDirs(path.Dir(file.path))
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d files from archive %s", removed, p.path)
+	}
+
+	return nil
+}
+
+// pruneDirs removes dir and its parents inside the archive, as long as they are empty
+func (p *ArchivePruner) pruneDirs(dir string) {
+	root := path.Clean(p.path)
+
+	for dir != root && len(dir) > len(root) {
+		if err := os.Remove(dir); err != nil {
+			// not empty or already gone
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// Run prunes the archive every Interval until quit is closed
+func (p *ArchivePruner) Run(quit <-chan bool) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Prune(); err != nil {
+			log.Print(err)
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
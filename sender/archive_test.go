@@ -0,0 +1,116 @@
+package sender
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileReader_Archive(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Recursive = true
+	r.Archive = "sent"
+	r.ArchiveBucket = ArchiveBuckets["daily"]
+
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sent long after they were written
+	old := time.Now().Add(-48 * time.Hour)
+
+	for _, file := range files {
+		_ = os.Chtimes(path.Join(spool, file.Name()), old, old)
+
+		if err := r.Done(file.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucket := path.Join(spool, "sent", time.Now().Format(r.ArchiveBucket))
+	archived, err := ioutil.ReadDir(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != FixtureFiles {
+		t.Fatalf("expected %d archived files, found %d", FixtureFiles, len(archived))
+	}
+
+	for _, file := range archived {
+		if time.Since(file.ModTime()) > time.Hour {
+			t.Fatalf("archived file %s should carry the time of archiving, found %s", file.Name(), file.ModTime())
+		}
+	}
+
+	// archived files are not sent again
+	if files, _ := r.ReadDir(); len(files) != 0 {
+		t.Fatalf("archive should not be read, found %d files", len(files))
+	}
+
+	// the same name is archived again
+	writeFile(t, spool, archived[0].Name(), TestContent)
+	if err := r.Done(archived[0].Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(bucket, archived[0].Name()+".1")); err != nil {
+		t.Fatal("archived file should not be replaced: ", err)
+	}
+}
+
+func TestArchivePruner(t *testing.T) {
+	archive, err := ioutil.TempDir(os.TempDir(), "filespooler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(archive)
+	}()
+
+	_ = os.MkdirAll(path.Join(archive, "2019", "01"), 0755)
+
+	for i, name := range []string{"2019/01/old", "newer", "newest"} {
+		writeFile(t, archive, name, TestContent)
+
+		mtime := time.Now().Add(time.Duration(i-2) * time.Hour)
+		if i == 0 {
+			mtime = time.Now().Add(-48 * time.Hour)
+		}
+		_ = os.Chtimes(path.Join(archive, name), mtime, mtime)
+	}
+
+	p := NewArchivePruner(archive)
+	p.MaxAge = 24 * time.Hour
+
+	if err := p.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(archive, "2019")); !os.IsNotExist(err) {
+		t.Fatal("expired file and its empty directories should be removed")
+	}
+
+	p.MaxBytes = int64(len(TestContent))
+	if err := p.Prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(archive, "newer")); !os.IsNotExist(err) {
+		t.Fatal("oldest file should be removed when the archive is too large")
+	}
+	if _, err := os.Stat(path.Join(archive, "newest")); err != nil {
+		t.Fatal("newest file should be kept: ", err)
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Fatal("archive itself should be kept: ", err)
+	}
+}
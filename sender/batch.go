@@ -0,0 +1,66 @@
+package sender
+
+import (
+	"container/heap"
+)
+
+// batch collects the first files by order while a directory is scanned, limited by number of files and bytes.
+//
+// Files are kept in a heap with the last file by order on top, so it can be dropped when a limit is exceeded.
+type batch struct {
+	order    fileOrder
+	maxFiles int
+	maxBytes int64
+	files    []*FileData
+	bytes    int64
+	// set when files have been dropped, the spool has more files than the batch
+	truncated bool
+}
+
+func (b *batch) Len() int {
+	return len(b.files)
+}
+
+func (b *batch) Less(i, j int) bool {
+	return b.order.less(b.files[j], b.files[i])
+}
+
+func (b *batch) Swap(i, j int) {
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+}
+
+func (b *batch) Push(x interface{}) {
+	b.files = append(b.files, x.(*FileData))
+}
+
+func (b *batch) Pop() interface{} {
+	last := b.files[len(b.files)-1]
+	b.files = b.files[:len(b.files)-1]
+	return last
+}
+
+// add a file to the batch, and drop the last files when a limit is exceeded.
+//
+// A single file is always kept, even when it is larger than maxBytes.
+func (b *batch) add(f *FileData) {
+	heap.Push(b, f)
+	b.bytes += f.Size()
+
+	for b.Len() > 1 && b.exceeded() {
+		dropped := heap.Pop(b).(*FileData)
+		b.bytes -= dropped.Size()
+		b.truncated = true
+	}
+}
+
+func (b *batch) exceeded() bool {
+	return (b.maxFiles > 0 && b.Len() > b.maxFiles) || (b.maxBytes > 0 && b.bytes > b.maxBytes)
+}
+
+// sorted returns the files of the batch in order
+func (b *batch) sorted() []*FileData {
+	files := make([]*FileData, len(b.files))
+	copy(files, b.files)
+	b.order.sort(files)
+	return files
+}
@@ -0,0 +1,58 @@
+package sender
+
+import (
+	"testing"
+)
+
+func testBatchFile(name string, size int64) *FileData {
+	f := NewFileData(name)
+	f.SetSize(size)
+	return f
+}
+
+func TestBatch(t *testing.T) {
+	b := &batch{order: fileOrder{order: OrderName}, maxFiles: 3}
+
+	for _, name := range []string{"e", "b", "d", "a", "c"} {
+		b.add(testBatchFile(name, 10))
+	}
+
+	files := b.sorted()
+	if len(files) != 3 || files[0].Name() != "a" || files[1].Name() != "b" || files[2].Name() != "c" {
+		t.Fatalf("batch should keep the first files by order: %v", files)
+	}
+	if !b.truncated {
+		t.Fatal("batch should be truncated")
+	}
+}
+
+func TestBatch_Bytes(t *testing.T) {
+	b := &batch{order: fileOrder{order: OrderName}, maxBytes: 25}
+
+	b.add(testBatchFile("c", 100))
+	if b.Len() != 1 || b.truncated {
+		t.Fatal("a single file should always be kept")
+	}
+
+	for _, name := range []string{"d", "a", "b"} {
+		b.add(testBatchFile(name, 10))
+	}
+
+	files := b.sorted()
+	if len(files) != 2 || files[0].Name() != "a" || files[1].Name() != "b" || b.bytes != 20 {
+		t.Fatalf("batch should be limited by bytes: %v", files)
+	}
+}
+
+func TestBatch_Unlimited(t *testing.T) {
+	b := &batch{order: fileOrder{order: OrderSmallest}}
+
+	for i := int64(100); i > 0; i-- {
+		b.add(testBatchFile("file", i))
+	}
+
+	files := b.sorted()
+	if len(files) != 100 || b.truncated || files[0].Size() != 1 {
+		t.Fatal("batch without limits should keep all files")
+	}
+}
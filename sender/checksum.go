@@ -0,0 +1,55 @@
+package sender
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+)
+
+// DefaultChecksum is the hash algorithm used to verify transfers when nothing else is configured
+const DefaultChecksum = "sha256"
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewChecksum returns a new hash for the named algorithm
+func NewChecksum(algorithm string) (hash.Hash, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+	return newHash(), nil
+}
+
+// ChecksumAlgorithms lists the names of all supported hash algorithms
+func ChecksumAlgorithms() []string {
+	var names []string
+	for name := range checksumAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checksumFile hashes size bytes from the current position of reader
+func checksumFile(reader io.Reader, size int64, algorithm string) ([]byte, error) {
+	h, err := NewChecksum(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.CopyN(h, reader, size); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,36 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewChecksum(t *testing.T) {
+	for _, name := range ChecksumAlgorithms() {
+		if _, err := NewChecksum(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewChecksum("crc0"); err == nil {
+		t.Fatal("Unknown algorithm should fail")
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+	sum, err := checksumFile(bytes.NewReader([]byte("abcdef")), 3, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(sum) != expected {
+		t.Fatalf("unexpected checksum %x", sum)
+	}
+
+	if _, err := checksumFile(bytes.NewReader([]byte("abc")), 10, "sha256"); err == nil {
+		t.Fatal("Hashing beyond the end of content should fail")
+	}
+}
@@ -0,0 +1,201 @@
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// CompressionGzip compresses file content with gzip
+	CompressionGzip = "gzip"
+	// MaxChunkSize limits the size of a single chunk of compressed content
+	MaxChunkSize = 1 << 20
+)
+
+type compressor struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressors = map[string]compressor{
+	CompressionGzip: {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// compressedSuffixes are file extensions of formats that would not get any smaller
+var compressedSuffixes = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4", ".zip", ".7z", ".rar",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp3", ".mp4", ".mkv",
+}
+
+// compressedMagic are the first bytes of compressed formats
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'P', 'K', 0x03, 0x04},             // zip
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+}
+
+// CompressionAlgorithms lists the names of all supported compression algorithms
+func CompressionAlgorithms() []string {
+	var names []string
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateCompression returns an error for unsupported algorithms, an empty string disables compression
+func ValidateCompression(algorithm string) error {
+	if _, ok := compressors[algorithm]; algorithm != "" && !ok {
+		return fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+	return nil
+}
+
+// NewDecompressor returns a reader for content compressed with algorithm
+func NewDecompressor(reader io.Reader, algorithm string) (io.ReadCloser, error) {
+	c, ok := compressors[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+	return c.newReader(reader)
+}
+
+func newCompressor(writer io.Writer, algorithm string) (io.WriteCloser, error) {
+	c, ok := compressors[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+	return c.newWriter(writer)
+}
+
+// isCompressed detects content that is already compressed, by the name of the file or its first bytes
+func isCompressed(name string, head []byte) bool {
+	suffix := strings.ToLower(path.Ext(name))
+	for _, s := range compressedSuffixes {
+		if suffix == s {
+			return true
+		}
+	}
+
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// chunkWriter frames compressed content, since its size is not known before it has been sent.
+//
+// Every chunk is prefixed by its length as 4 bytes in network order, a chunk of length 0 ends the content.
+type chunkWriter struct {
+	writer io.Writer
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxChunkSize {
+			chunk = chunk[:MaxChunkSize]
+		}
+
+		if err := w.writeLength(len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Close writes the final chunk, the underlying writer is not closed
+func (w *chunkWriter) Close() error {
+	return w.writeLength(0)
+}
+
+func (w *chunkWriter) writeLength(length int) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(length))
+	_, err := w.writer.Write(header[:])
+	return err
+}
+
+// ChunkReader reads content framed by the sender, and returns io.EOF after the final chunk
+type ChunkReader struct {
+	reader io.Reader
+	left   uint32
+	done   bool
+}
+
+func NewChunkReader(reader io.Reader) *ChunkReader {
+	return &ChunkReader{reader: reader}
+}
+
+func (r *ChunkReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	if r.left == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+
+		r.left = binary.BigEndian.Uint32(header[:])
+		if r.left == 0 {
+			r.done = true
+			return 0, io.EOF
+		}
+		if r.left > MaxChunkSize {
+			return 0, fmt.Errorf("chunk of %d bytes exceeds the limit of %d", r.left, MaxChunkSize)
+		}
+	}
+
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+
+	n, err := r.reader.Read(p)
+	r.left -= uint32(n)
+
+	return n, unexpectedEOF(err)
+}
+
+// unexpectedEOF turns io.EOF into an error, the stream must not end within chunked content
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package sender
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSendCompressed(t *testing.T) {
+	content := strings.Repeat(TestContent+"\n", 1000)
+
+	var stream bytes.Buffer
+	if err := sendCompressed(&stream, strings.NewReader(content), int64(len(content)), CompressionGzip); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() >= len(content) {
+		t.Fatalf("content should be smaller when compressed, got %d bytes", stream.Len())
+	}
+
+	// data following the content must not be consumed
+	stream.WriteString("NEXT\n")
+
+	chunks := NewChunkReader(&stream)
+	decompressed, err := NewDecompressor(chunks, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ioutil.ReadAll(decompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != content {
+		t.Fatal("decompressed content does not match")
+	}
+
+	if _, err := io.Copy(ioutil.Discard, chunks); err != nil {
+		t.Fatal(err)
+	}
+	if stream.String() != "NEXT\n" {
+		t.Fatalf("stream should continue after the content, found %q", stream.String())
+	}
+}
+
+func TestChunkReader_Truncated(t *testing.T) {
+	var stream bytes.Buffer
+	w := &chunkWriter{writer: &stream}
+	_, _ = w.Write([]byte("some content"))
+
+	stream.Truncate(stream.Len() - 2)
+
+	if _, err := ioutil.ReadAll(NewChunkReader(&stream)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated content should fail, got %v", err)
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     []byte
+		expected bool
+	}{
+		{"metrics.txt", []byte("cpu=1"), false},
+		{"archive.tar.GZ", []byte("cpu=1"), true},
+		{"data", []byte{0x1f, 0x8b, 0x08}, true},
+		{"data", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, true},
+		{"empty", nil, false},
+	}
+
+	for _, test := range tests {
+		if isCompressed(test.name, test.head) != test.expected {
+			t.Errorf("isCompressed(%s, %x) should be %v", test.name, test.head, test.expected)
+		}
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	if err := ValidateCompression(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateCompression(CompressionGzip); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateCompression("lzma"); err == nil {
+		t.Fatal("unknown algorithm should fail")
+	}
+}
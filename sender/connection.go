@@ -0,0 +1,545 @@
+package sender
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"github.com/lazyfrosch/filespooler/util"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// connection is a single session with the receiver, a Sender uses one per worker
+type connection struct {
+	sender *Sender
+	// address of the receiver
+	addr string
+	// time of the handshake
+	opened time.Time
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	peer   *Hello
+	// id of the last file sent on this connection
+	lastId uint64
+}
+
+// dial connects to a receiver and runs the handshake
+func (s *Sender) dial(addr string) (*connection, error) {
+	log.Printf("Connecting to %s", addr)
+
+	_, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse address %s: %s", addr, err)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, ConnectTimeout*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %s", addr, err)
+	}
+
+	c := &connection{sender: s, addr: addr}
+
+	if s.TlsConfig != nil {
+		var tlsConn *tls.Conn
+
+		err := conn.SetReadDeadline(time.Now().Add(ConnectTimeout * time.Second))
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("could not set deadline: %s", err)
+		}
+
+		// workers connect at the same time, they must not share the config
+		config := s.TlsConfig.Clone()
+		config.ServerName = util.GetNameFromTCPAddr(addr)
+
+		tlsConn = tls.Client(conn, config)
+
+		err = tlsConn.Handshake()
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("TLS Handshake failed: %s", err)
+		}
+
+		c.conn = tlsConn
+	} else {
+		c.conn = conn
+	}
+
+	c.rw = bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
+
+	if err := c.handshake(); err != nil {
+		_ = c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// handshake exchanges HELLO with the receiver and makes sure it agrees to all required capabilities
+func (c *connection) handshake() error {
+	s := c.sender
+	required, optional := s.capabilities()
+	hello := NewHello(s.Identity, append(required, optional...))
+
+	c.setTimeout()
+	if _, err := c.rw.WriteString(hello.String() + "\n"); err != nil {
+		return fmt.Errorf("could not send HELLO: %s", err)
+	}
+	if err := c.rw.Flush(); err != nil {
+		return fmt.Errorf("could not send HELLO: %s", err)
+	}
+
+	response, err := c.rw.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error waiting for HELLO from %s: %s", c.addr, err)
+	}
+
+	response = strings.Trim(response, "\n")
+	if strings.HasPrefix(response, "ERR") {
+		return fmt.Errorf("receiver %s refused handshake: %s", c.addr, ParseResponse(response))
+	}
+
+	peer, err := ParseHello(response)
+	if err != nil {
+		return err
+	}
+
+	if peer.Version < MinProtocolVersion || peer.Version > ProtocolVersion {
+		return fmt.Errorf("receiver %s speaks unsupported protocol version %d", c.addr, peer.Version)
+	}
+
+	for _, capability := range required {
+		if !peer.Has(capability) {
+			return fmt.Errorf("receiver %s (%s) does not support %s", c.addr, peer.Identity, capability)
+		}
+	}
+
+	log.Printf("Connected to %s (%s) with protocol version %d", c.addr, peer.Identity, peer.Version)
+
+	if s.Compression != "" && !peer.Has(CapabilityCompression+s.Compression) {
+		log.Printf("Receiver %s does not support %s compression, sending files uncompressed", c.addr, s.Compression)
+	}
+
+	if s.Window > 1 && !peer.Has(CapabilityWindow) {
+		log.Printf("Receiver %s does not support a window, sending one file at a time", c.addr)
+	}
+
+	c.peer = peer
+	c.opened = time.Now()
+
+	return nil
+}
+
+func (c *connection) setTimeout() {
+	_ = c.conn.SetDeadline(time.Now().Add(DataTimeout * time.Second))
+}
+
+// ackTimeout is the time to wait for the acknowledgement of a file, the receiver syncs it to disk before answering
+func ackTimeout(size int64) time.Duration {
+	return DataTimeout*time.Second + time.Duration(size/MinSyncRate)*time.Second
+}
+
+func (c *connection) keepalive() error {
+	c.setTimeout()
+	if _, err := c.rw.WriteString("KEEPALIVE\n"); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// keepaliveUntil sends KEEPALIVE every KeepaliveInterval until done is closed, while the connection has nothing to send
+func (c *connection) keepaliveUntil(done <-chan bool) error {
+	ticker := time.NewTicker(KeepaliveInterval * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			if err := c.keepalive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// keepaliveReader sends KEEPALIVE to the receiver every KeepaliveInterval, while a file is read locally
+type keepaliveReader struct {
+	io.Reader
+	conn *connection
+	last time.Time
+	// set when the keepalive failed, the connection is broken
+	err error
+}
+
+func (r *keepaliveReader) Read(p []byte) (int, error) {
+	if time.Since(r.last) >= KeepaliveInterval*time.Second {
+		if r.err = r.conn.keepalive(); r.err != nil {
+			return 0, r.err
+		}
+		r.last = time.Now()
+	}
+
+	return r.Reader.Read(p)
+}
+
+func (c *connection) close() error {
+	return c.conn.Close()
+}
+
+// sendFiles sends files from queue and returns how many were acknowledged by the receiver.
+//
+// When the receiver supports it, up to Window files are sent before waiting for their acknowledgement.
+// Sending stops when the queue is closed and empty, or when the sender is stopped or paused.
+func (c *connection) sendFiles(queue <-chan *FileData) (int, error) {
+	s := c.sender
+
+	window := 1
+	if c.peer.Has(CapabilityWindow) && s.Window > 1 {
+		window = s.Window
+	}
+
+	var inflight []*inflightFile
+	sent := 0
+	done := false
+
+	// taken from the queue, but waits until nothing is in flight, to ask for the offset to resume at
+	var next *FileData
+
+	for {
+		if next == nil && !done && len(inflight) < window {
+			file, ok := c.nextFile(queue, len(inflight) == 0)
+			if !ok {
+				done = true
+			}
+			next = file
+		}
+
+		if next != nil && (len(inflight) == 0 || !c.resumable(next)) {
+			f := &inflightFile{file: next}
+			next = nil
+
+			if c.peer.Has(CapabilityWindow) {
+				c.lastId++
+				f.id = c.lastId
+			}
+
+			if err := c.sendFile(f.file, f.id); err != nil {
+				if _, ok := err.(*fileError); !ok {
+					return sent, err
+				}
+
+				// nothing has been sent for this file, continue with the others
+				if err := s.fileFailed(f.file, err); err != nil {
+					return sent, err
+				}
+				continue
+			}
+
+			inflight = append(inflight, f)
+			continue
+		}
+
+		if len(inflight) == 0 {
+			// nothing in flight and no more files to take
+			return sent, nil
+		}
+
+		// wait for the oldest file, the receiver handles files in order
+		f := inflight[0]
+		inflight = inflight[1:]
+
+		response, err := c.readResponse(f)
+		if err != nil {
+			return sent, err
+		}
+
+		if err := ParseResponse(response); err != nil {
+			stop, err := s.handleResponseError(f.file, err.(*ResponseError))
+			if err != nil {
+				return sent, fmt.Errorf("peer did not acknowledge %s: %s", f.file.RawName, err)
+			}
+			if stop {
+				// files in flight still get their response, a waiting file stays in the spool
+				done = true
+				next = nil
+			}
+			continue
+		}
+
+		// the receiver answered, whatever happens to the file locally
+		s.connectionWorks()
+
+		// Delete or archive file when it was sent, a failure only affects this file
+		if err := s.done(f.file); err != nil {
+			if err := s.fileFailed(f.file, fmt.Errorf("sent, but could not be finished: %s", err)); err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		s.fileSent(f.file)
+
+		sent++
+	}
+}
+
+// nextFile takes a file from the queue, it only waits for one when wait is set.
+//
+// Returns false when no more files should be taken.
+func (c *connection) nextFile(queue <-chan *FileData, wait bool) (*FileData, bool) {
+	s := c.sender
+
+	select {
+	case <-s.quit:
+		return nil, false
+	default:
+	}
+
+	if s.paused() {
+		return nil, false
+	}
+
+	if wait {
+		file, ok := <-queue
+		return file, ok
+	}
+
+	select {
+	case file, ok := <-queue:
+		return file, ok
+	default:
+		return nil, true
+	}
+}
+
+// fileError is a problem with a local file, that occurred before anything was sent for it
+type fileError struct {
+	err error
+}
+
+func (e *fileError) Error() string {
+	return e.err.Error()
+}
+
+// inflightFile is a file that has been sent and waits for its response
+type inflightFile struct {
+	// id in SEND_FILE and ACK, 0 when the window is not supported
+	id   uint64
+	file *FileData
+}
+
+// readResponse waits for the response of the receiver for a file
+func (c *connection) readResponse(f *inflightFile) (string, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(ackTimeout(f.file.RawSize)))
+	response, err := c.rw.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error waiting for response for sent file: %s", err)
+	}
+
+	if f.id == 0 {
+		return response, nil
+	}
+
+	id, response, err := ParseAck(response)
+	if err != nil {
+		return "", err
+	}
+
+	if id != f.id {
+		return "", fmt.Errorf("expected ACK for %s with id %d, got %d", f.file.RawName, f.id, id)
+	}
+
+	return response, nil
+}
+
+// sendFile writes the command and header for a file, and streams its content from disk to the peer
+func (c *connection) sendFile(file *FileData, id uint64) error {
+	s := c.sender
+
+	fh, err := s.reader.Open(file)
+	if err != nil {
+		return &fileError{err}
+	}
+
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	if s.Checksum != "" {
+		// hashing a large file takes a while, the receiver must not drop the idle connection meanwhile
+		reader := &keepaliveReader{Reader: fh, conn: c, last: time.Now()}
+
+		sum, err := checksumFile(reader, file.RawSize, s.Checksum)
+		if reader.err != nil {
+			return fmt.Errorf("could not send keepalive while hashing %s: %s", file.RawName, reader.err)
+		}
+		if err != nil {
+			return &fileError{fmt.Errorf("could not calculate checksum for %s: %s", file.RawName, err)}
+		}
+
+		file.SetChecksum(s.Checksum, sum)
+
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return &fileError{fmt.Errorf("could not rewind file %s: %s", file.RawName, err)}
+		}
+	}
+
+	file.SetDeliveryId("")
+	if c.peer.Has(CapabilityDedup) {
+		file.SetDeliveryId(NewDeliveryId(s.Identity, file))
+	}
+
+	offset := int64(0)
+	file.SetTransferId("")
+
+	if c.resumable(file) {
+		file.SetTransferId(NewTransferId(file))
+
+		if offset, err = c.queryOffset(file); err != nil {
+			if respErr, ok := err.(*ResponseError); !ok || respErr.Class == ErrorProtocol {
+				return err
+			}
+
+			log.Printf("Could not resume %s, sending the whole file: %s", file.RawName, err)
+			file.SetTransferId("")
+			offset = 0
+		}
+
+		if offset > 0 {
+			if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+				return &fileError{fmt.Errorf("could not seek in file %s: %s", file.RawName, err)}
+			}
+			log.Printf("Resuming file %s at %d bytes", file.RawName, offset)
+		}
+	}
+
+	file.SetOffset(offset)
+
+	compression, err := c.compression(file, fh)
+	if err != nil {
+		return &fileError{err}
+	}
+
+	// the same file might be sent again over another connection
+	file.SetCompression(compression)
+
+	c.setTimeout()
+
+	log.Printf("Sending file %s (%d bytes)", file.RawName, file.RawSize)
+
+	cmd := "SEND_FILE\n"
+	if id != 0 {
+		cmd = fmt.Sprintf("SEND_FILE %d\n", id)
+	}
+
+	if _, err := c.rw.WriteString(cmd); err != nil {
+		return fmt.Errorf("could not sent command: %s", err)
+	}
+
+	enc := gob.NewEncoder(c.rw)
+	if err := enc.Encode(file); err != nil {
+		return fmt.Errorf("could not send encoded data: %s", err)
+	}
+
+	body := &util.DeadlineWriter{Writer: c.rw, Conn: c.conn, Timeout: DataTimeout * time.Second}
+	if compression != "" {
+		err = sendCompressed(body, fh, file.Remaining(), compression)
+	} else {
+		_, err = io.CopyN(body, fh, file.Remaining())
+	}
+	if err == io.EOF {
+		// the stream is broken anyway, but the file is to blame
+		_ = s.fileFailed(file, fmt.Errorf("file is shorter than %d bytes", file.RawSize))
+	}
+	if err != nil {
+		return fmt.Errorf("could not send content of %s: %s", file.RawName, err)
+	}
+
+	c.setTimeout()
+	if err := c.rw.Flush(); err != nil {
+		return fmt.Errorf("could not flush data: %s", err)
+	}
+
+	return nil
+}
+
+// resumable returns true when an interrupted transfer of file can be continued
+func (c *connection) resumable(file *FileData) bool {
+	s := c.sender
+	return c.peer.Has(CapabilityResume) && s.Checksum != "" && s.ResumeSize > 0 && file.RawSize >= s.ResumeSize
+}
+
+// queryOffset asks the receiver how much of a file it already has, nothing must be in flight
+func (c *connection) queryOffset(file *FileData) (int64, error) {
+	c.setTimeout()
+
+	if _, err := c.rw.WriteString("RESUME " + file.TransferId() + "\n"); err != nil {
+		return 0, fmt.Errorf("could not send command: %s", err)
+	}
+	if err := c.rw.Flush(); err != nil {
+		return 0, fmt.Errorf("could not flush data: %s", err)
+	}
+
+	response, err := c.rw.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("error waiting for offset of %s: %s", file.RawName, err)
+	}
+
+	offset, err := ParseOffset(response)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset > file.RawSize {
+		// the receiver should have refused the transfer id, start again
+		return 0, nil
+	}
+
+	return offset, nil
+}
+
+// compression returns the algorithm for the content of a file, empty when it is not compressed
+func (c *connection) compression(file *FileData, fh io.ReaderAt) (string, error) {
+	algorithm := c.sender.Compression
+	if algorithm == "" || !c.peer.Has(CapabilityCompression+algorithm) {
+		return "", nil
+	}
+
+	head := make([]byte, 8)
+	n, err := fh.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read %s: %s", file.RawName, err)
+	}
+
+	if isCompressed(file.RawName, head[:n]) {
+		return "", nil
+	}
+
+	return algorithm, nil
+}
+
+// sendCompressed compresses size bytes of content and writes them in chunks
+func sendCompressed(writer io.Writer, content io.Reader, size int64, algorithm string) error {
+	chunks := &chunkWriter{writer: writer}
+
+	compressed, err := newCompressor(chunks, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(compressed, content, size); err != nil {
+		return err
+	}
+
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+
+	return chunks.Close()
+}
@@ -3,15 +3,38 @@ package sender
 import (
 	"encoding/gob"
 	"io"
+	"os"
+	"time"
 )
 
+// FileData is the header sent in front of every file, the content follows as a raw stream of Size() bytes.
+//
+// When Compression() is set, the content follows compressed, in chunks written by chunkWriter.
+// When Offset() is set, the content starts at that offset, the first part has been received before.
 type FileData struct {
-	RawName    string
-	RawContent []byte
+	RawName         string
+	RawSize         int64
+	RawChecksumType string
+	RawChecksum     []byte
+	RawModTime      time.Time
+	RawMode         os.FileMode
+	RawOwner        *FileOwner
+	RawCompression  string
+	RawTransferId   string
+	RawOffset       int64
+	RawDeliveryId   string
+}
+
+// FileOwner is the optional ownership of a file on the sender, names are empty when they could not be resolved
+type FileOwner struct {
+	Uid   int
+	Gid   int
+	User  string
+	Group string
 }
 
 func NewFileData(name string) *FileData {
-	return &FileData{name, nil}
+	return &FileData{RawName: name}
 }
 
 func DecodeGobFileData(reader io.Reader) (*FileData, error) {
@@ -27,14 +50,96 @@ func (f *FileData) Name() string {
 	return f.RawName
 }
 
-func (f *FileData) Content() []byte {
-	return f.RawContent
+// SetName changes the name of the file, the receiver uses it to place the file below the target
+func (f *FileData) SetName(name string) {
+	f.RawName = name
+}
+
+func (f *FileData) Size() int64 {
+	return f.RawSize
+}
+
+func (f *FileData) SetSize(size int64) {
+	f.RawSize = size
+}
+
+// ChecksumType returns the name of the hash algorithm, or an empty string when no checksum is included
+func (f *FileData) ChecksumType() string {
+	return f.RawChecksumType
+}
+
+func (f *FileData) Checksum() []byte {
+	return f.RawChecksum
+}
+
+func (f *FileData) SetChecksum(algorithm string, sum []byte) {
+	f.RawChecksumType = algorithm
+	f.RawChecksum = sum
+}
+
+// Compression returns the algorithm the content is compressed with, or an empty string for raw content
+func (f *FileData) Compression() string {
+	return f.RawCompression
+}
+
+func (f *FileData) SetCompression(algorithm string) {
+	f.RawCompression = algorithm
+}
+
+// TransferId identifies the content of a file for resuming, empty when the transfer can not be resumed
+func (f *FileData) TransferId() string {
+	return f.RawTransferId
+}
+
+func (f *FileData) SetTransferId(id string) {
+	f.RawTransferId = id
+}
+
+// Offset is the position in the file the content starts at
+func (f *FileData) Offset() int64 {
+	return f.RawOffset
+}
+
+func (f *FileData) SetOffset(offset int64) {
+	f.RawOffset = offset
+}
+
+// DeliveryId identifies the file for duplicate detection on the receiver, empty when not used
+func (f *FileData) DeliveryId() string {
+	return f.RawDeliveryId
+}
+
+func (f *FileData) SetDeliveryId(id string) {
+	f.RawDeliveryId = id
+}
+
+// Remaining returns the number of bytes sent as content, from Offset() to the end of the file
+func (f *FileData) Remaining() int64 {
+	return f.RawSize - f.RawOffset
+}
+
+// SetFileInfo copies size, modification time and permission bits from a stat of the file
+func (f *FileData) SetFileInfo(info os.FileInfo) {
+	f.RawSize = info.Size()
+	f.RawModTime = info.ModTime()
+	f.RawMode = info.Mode().Perm()
+}
+
+// ModTime returns the modification time, which is zero when the sender did not include it
+func (f *FileData) ModTime() time.Time {
+	return f.RawModTime
+}
+
+// Mode returns the permission bits, which are zero when the sender did not include them
+func (f *FileData) Mode() os.FileMode {
+	return f.RawMode
 }
 
-func (f *FileData) SetContent(content []byte) {
-	f.RawContent = content
+// Owner returns the ownership on the sender, or nil when it was not included
+func (f *FileData) Owner() *FileOwner {
+	return f.RawOwner
 }
 
-func (f *FileData) Size() int {
-	return len(f.RawContent)
+func (f *FileData) SetOwner(owner *FileOwner) {
+	f.RawOwner = owner
 }
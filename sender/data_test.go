@@ -2,7 +2,11 @@ package sender
 
 import (
 	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestNewFileData(t *testing.T) {
@@ -12,32 +16,90 @@ func TestNewFileData(t *testing.T) {
 	}
 }
 
-func TestFileData_Content(t *testing.T) {
-	data := []byte("testdata")
+func TestFileData_Size(t *testing.T) {
+	expected := int64(8)
 	f := NewFileData("test")
-	f.SetContent(data)
 
-	storedData := f.Content()
-	if &storedData == &data {
-		t.Fatal("No pointers should be used for data")
+	if f.Size() != 0 {
+		t.Fatal("Size should be 0 without data")
 	}
 
-	if bytes.Compare(data, storedData) != 0 {
-		t.Fatal("Stored data does not match input")
+	f.SetSize(expected)
+	if f.Size() != expected {
+		t.Fatalf("Size should be %d after setting it", expected)
 	}
 }
 
-func TestFileData_Size(t *testing.T) {
-	data := []byte("testdata")
-	expected := 8
+func TestDecodeGobFileData(t *testing.T) {
+	var buf bytes.Buffer
 	f := NewFileData("test")
+	f.SetSize(1024)
 
-	if f.Size() != 0 {
-		t.Fatal("Size should be 0 without data")
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		t.Fatal(err)
 	}
 
-	f.SetContent(data)
-	if f.Size() != expected {
-		t.Fatalf("Size should be %d without data", expected)
+	// content is streamed right after the header
+	buf.WriteString("content")
+
+	decoded, err := DecodeGobFileData(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Name() != f.Name() || decoded.Size() != f.Size() {
+		t.Fatalf("Decoded header does not match: %v", decoded)
+	}
+
+	if buf.String() != "content" {
+		t.Fatalf("Decoder consumed more than the header: %q", buf.String())
+	}
+}
+
+func TestFileData_Checksum(t *testing.T) {
+	f := NewFileData("test")
+	if f.ChecksumType() != "" || f.Checksum() != nil {
+		t.Fatal("No checksum should be set by default")
+	}
+
+	f.SetChecksum("sha256", []byte{1, 2, 3})
+	if f.ChecksumType() != "sha256" || !bytes.Equal(f.Checksum(), []byte{1, 2, 3}) {
+		t.Fatal("Checksum was not stored")
+	}
+}
+
+func TestFileData_SetFileInfo(t *testing.T) {
+	fh, err := ioutil.TempFile("", "filespooler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(fh.Name())
+	}()
+
+	_, _ = fh.WriteString("testdata")
+	_ = fh.Close()
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(fh.Name(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fh.Name(), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(fh.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFileData("test")
+	f.SetFileInfo(info)
+
+	if f.Size() != 8 || !f.ModTime().Equal(mtime) || f.Mode() != 0750 {
+		t.Fatalf("FileData does not match file info: %v", f)
+	}
+	if f.Owner() != nil {
+		t.Fatal("Owner should not be set by default")
 	}
 }
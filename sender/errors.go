@@ -0,0 +1,107 @@
+package sender
+
+import (
+	"log"
+	"time"
+)
+
+// ErrorBackoff is the time in seconds sending pauses when the receiver can not store files at the moment
+const ErrorBackoff = 30
+
+// DefaultMaxRetries is the default number of failed attempts before a file is moved to quarantine
+const DefaultMaxRetries = 5
+
+type errorAction int
+
+const (
+	// keep the file and send it again with the next check, until MaxRetries is reached
+	actionRetry errorAction = iota
+	// keep the file and pause sending for a while
+	actionBackoff
+	// move the file out of the spool
+	actionQuarantine
+	// keep the file, but don't send it again until restart
+	actionSkip
+	// the connection can not be trusted anymore
+	actionReconnect
+)
+
+// errorActions defines how an error class reported by the receiver is handled
+var errorActions = map[string]errorAction{
+	ErrorChecksum:     actionRetry,
+	ErrorInternal:     actionRetry,
+	ErrorExists:       actionRetry,
+	ErrorDiskFull:     actionBackoff,
+	ErrorQuota:        actionBackoff,
+	ErrorPermission:   actionBackoff,
+	ErrorNameRejected: actionQuarantine,
+	ErrorProtocol:     actionReconnect,
+}
+
+func actionForError(err *ResponseError) errorAction {
+	if action, ok := errorActions[err.Class]; ok {
+		return action
+	}
+	return actionSkip
+}
+
+// handleResponseError applies the action for a rejected file, and returns true when the current run should stop
+func (s *Sender) handleResponseError(file *FileData, respErr *ResponseError) (bool, error) {
+	switch actionForError(respErr) {
+	case actionRetry:
+		log.Printf("Receiver rejected %s: %s", file.RawName, respErr)
+		return false, s.fileFailed(file, respErr)
+	case actionBackoff:
+		log.Printf("Receiver rejected %s, pausing for %d seconds: %s", file.RawName, ErrorBackoff, respErr)
+		s.pause(ErrorBackoff * time.Second)
+		return true, nil
+	case actionQuarantine:
+		log.Printf("Receiver rejected %s, moving it to quarantine: %s", file.RawName, respErr)
+		if err := s.reader.QuarantineWithError(file.RawName, respErr.Error()); err != nil {
+			return true, err
+		}
+	case actionSkip:
+		log.Printf("Receiver rejected %s, skipping file until restart: %s", file.RawName, respErr)
+		s.reader.Skip(file.RawName)
+	case actionReconnect:
+		return true, respErr
+	}
+
+	return false, nil
+}
+
+// fileFailed counts a failed attempt to send a file, and moves it to quarantine when MaxRetries is reached.
+//
+// The connection is still usable, so other files keep being sent.
+func (s *Sender) fileFailed(file *FileData, reason error) error {
+	s.mu.Lock()
+	s.failures[file.RawName]++
+	attempts := s.failures[file.RawName]
+	if s.MaxRetries > 0 && attempts >= s.MaxRetries {
+		delete(s.failures, file.RawName)
+	}
+	s.mu.Unlock()
+
+	if s.MaxRetries <= 0 || attempts < s.MaxRetries {
+		log.Printf("Could not send %s, keeping file for retry (attempt %d): %s", file.RawName, attempts, reason)
+		return nil
+	}
+
+	log.Printf("Could not send %s after %d attempts, moving it to quarantine: %s", file.RawName, attempts, reason)
+
+	if err := s.reader.QuarantineWithError(file.RawName, reason.Error()); err != nil {
+		// the file might not even be readable, don't let it block the others
+		log.Printf("%s, skipping file until restart", err)
+		s.reader.Skip(file.RawName)
+	}
+
+	return nil
+}
+
+// fileSent forgets failed attempts of a file
+func (s *Sender) fileSent(file *FileData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, file.RawName)
+}
@@ -0,0 +1,79 @@
+package sender
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestActionForError(t *testing.T) {
+	tests := map[string]errorAction{
+		ErrorChecksum:     actionRetry,
+		ErrorExists:       actionRetry,
+		ErrorDiskFull:     actionBackoff,
+		ErrorQuota:        actionBackoff,
+		ErrorNameRejected: actionQuarantine,
+		ErrorProtocol:     actionReconnect,
+		"unknown":         actionSkip,
+	}
+
+	for class, expected := range tests {
+		if action := actionForError(NewResponseError(class, "test")); action != expected {
+			t.Fatalf("action for %s is %d, expected %d", class, action, expected)
+		}
+	}
+}
+
+func TestSender_FileFailed(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSender("localhost:0", r)
+	s.MaxRetries = 3
+
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := files[0]
+	respErr := NewResponseError(ErrorChecksum, "mismatch")
+
+	for i := 0; i < s.MaxRetries-1; i++ {
+		if stop, err := s.handleResponseError(file, respErr); stop || err != nil {
+			t.Fatalf("retry should not stop sending: %v", err)
+		}
+	}
+
+	// a successful attempt resets the count
+	s.fileSent(file)
+	for i := 0; i < s.MaxRetries-1; i++ {
+		_, _ = s.handleResponseError(file, respErr)
+	}
+	if _, err := os.Stat(path.Join(spool, file.Name())); err != nil {
+		t.Fatal("file should be kept for retry: ", err)
+	}
+
+	_, _ = s.handleResponseError(file, respErr)
+
+	if _, err := os.Stat(path.Join(spool, QuarantineDir, file.Name())); err != nil {
+		t.Fatal("file should be in quarantine: ", err)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(spool, QuarantineDir, file.Name()+QuarantineErrorSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "checksum: mismatch") {
+		t.Fatalf("last error should be kept next to the file, found: %s", content)
+	}
+}
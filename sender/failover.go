@@ -0,0 +1,147 @@
+package sender
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Policies for choosing another receiver, when the current one can not be reached
+const (
+	// FailoverPriority tries the receivers in the order given, and returns to the primary once it is available again
+	FailoverPriority = "priority"
+	// FailoverRoundRobin continues with the receiver after the one that failed, and stays there while it works
+	FailoverRoundRobin = "round-robin"
+)
+
+// DefaultFailbackInterval is the default time between checks whether the primary receiver is available again
+const DefaultFailbackInterval = 60 * time.Second
+
+func ValidateFailover(mode string) error {
+	switch mode {
+	case "", FailoverPriority, FailoverRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("unknown failover policy: %s", mode)
+	}
+}
+
+// targets returns the addresses of all receivers, the primary first
+func (s *Sender) targets() []string {
+	return append([]string{s.addr}, s.Failover...)
+}
+
+// target returns the address of the receiver currently sent to
+func (s *Sender) target() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.targets()[s.current]
+}
+
+// candidates returns the indexes of the receivers to try in order, starting with the current one
+func (s *Sender) candidates() []int {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+
+	count := len(s.targets())
+	order := []int{current}
+
+	for n := 1; n < count; n++ {
+		if s.FailoverMode == FailoverRoundRobin {
+			order = append(order, (current+n)%count)
+		} else if i := n - 1; i < current {
+			// the primary might be back already
+			order = append(order, i)
+		} else {
+			order = append(order, n)
+		}
+	}
+
+	return order
+}
+
+// dialTarget connects to the current receiver, or fails over to the next one that can be reached
+func (s *Sender) dialTarget() (*connection, error) {
+	targets := s.targets()
+
+	var errors []string
+
+	for _, i := range s.candidates() {
+		c, err := s.dial(targets[i])
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+
+		s.switchTarget(i)
+
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("%s", strings.Join(errors, "; "))
+}
+
+// switchTarget makes receiver i the current one
+func (s *Sender) switchTarget(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i == s.current {
+		return
+	}
+
+	targets := s.targets()
+	log.Printf("Failing over from %s to %s", targets[s.current], targets[i])
+
+	s.current = i
+	s.failedOver = time.Now()
+}
+
+// failback returns to the primary receiver, when it is available again in FailoverPriority mode.
+//
+// Only called between batches, so no files are in flight on the connections that are closed.
+func (s *Sender) failback() {
+	if s.FailoverMode == FailoverRoundRobin || s.FailbackInterval <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	due := s.current != 0 && time.Since(s.failedOver) >= s.FailbackInterval
+	if due {
+		// also delays the next check when the primary is still down
+		s.failedOver = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !due {
+		return
+	}
+
+	c, err := s.dial(s.addr)
+	if err != nil {
+		log.Printf("Primary receiver %s is still not available: %s", s.addr, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Printf("Primary receiver %s is available again, returning from %s", s.addr, s.targets()[s.current])
+
+	for i, old := range s.conns {
+		if old != nil {
+			_ = old.close()
+			s.conns[i] = nil
+		}
+	}
+
+	if len(s.conns) == 0 {
+		s.conns = append(s.conns, nil)
+	}
+
+	s.conns[0] = c
+	s.current = 0
+}
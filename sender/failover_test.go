@@ -0,0 +1,131 @@
+package sender
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeReceiver accepts connections and answers the handshake, without any capabilities.
+//
+// The connection is closed on the first command after the handshake.
+func fakeReceiver(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+				if _, err := rw.ReadString('\n'); err != nil {
+					return
+				}
+				_, _ = rw.WriteString(NewHello("fake", nil).String() + "\n")
+				_ = rw.Flush()
+
+				_, _ = rw.ReadString('\n')
+			}()
+		}
+	}()
+
+	return l
+}
+
+// unusedAddr returns an address nothing listens on
+func unusedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	return addr
+}
+
+func TestValidateFailover(t *testing.T) {
+	for _, mode := range []string{"", FailoverPriority, FailoverRoundRobin} {
+		if err := ValidateFailover(mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ValidateFailover("random"); err == nil {
+		t.Fatal("unknown policy should be rejected")
+	}
+}
+
+func TestSender_Candidates(t *testing.T) {
+	s := NewSender("a:5664", &FileReader{})
+	s.Failover = []string{"b:5664", "c:5664", "d:5664"}
+	s.current = 2
+
+	if order := s.candidates(); !reflect.DeepEqual(order, []int{2, 0, 1, 3}) {
+		t.Fatalf("unexpected order for priority: %v", order)
+	}
+
+	s.FailoverMode = FailoverRoundRobin
+
+	if order := s.candidates(); !reflect.DeepEqual(order, []int{2, 3, 0, 1}) {
+		t.Fatalf("unexpected order for round-robin: %v", order)
+	}
+}
+
+func TestSender_Failover(t *testing.T) {
+	primary := unusedAddr(t)
+
+	failover := fakeReceiver(t)
+	defer func() {
+		_ = failover.Close()
+	}()
+
+	s := NewSender(primary, &FileReader{})
+	s.Checksum = ""
+	s.Workers = 2
+	s.Failover = []string{unusedAddr(t), failover.Addr().String()}
+	s.FailbackInterval = 1
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	if s.target() != failover.Addr().String() || len(s.connected()) != 2 {
+		t.Fatalf("workers should have failed over, status: %s", s.Status())
+	}
+
+	// primary still down
+	s.failback()
+
+	if s.target() == primary {
+		t.Fatal("should not return to a primary that is down")
+	}
+
+	// primary comes back, on another port
+	recovered := fakeReceiver(t)
+	defer func() {
+		_ = recovered.Close()
+	}()
+
+	s.addr = recovered.Addr().String()
+	s.failback()
+
+	if s.target() != s.addr || len(s.connected()) != 1 || !s.needsReconnect() {
+		t.Fatalf("should have returned to the primary, status: %s", s.Status())
+	}
+}
@@ -0,0 +1,68 @@
+package sender
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// Filter selects files in the spool by their name, relative to the spool
+type Filter interface {
+	Match(name string) bool
+	String() string
+}
+
+type globFilter struct {
+	pattern string
+}
+
+// NewGlobFilter matches a shell pattern against the base name, or the relative path when it contains a separator
+func NewGlobFilter(pattern string) (Filter, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err)
+	}
+	return &globFilter{pattern}, nil
+}
+
+func (f *globFilter) Match(name string) bool {
+	if ok, _ := path.Match(f.pattern, name); ok {
+		return true
+	}
+	ok, _ := path.Match(f.pattern, path.Base(name))
+	return ok
+}
+
+func (f *globFilter) String() string {
+	return f.pattern
+}
+
+type regexFilter struct {
+	re *regexp.Regexp
+}
+
+// NewRegexFilter matches a regular expression against the relative path
+func NewRegexFilter(expr string) (Filter, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %s: %s", expr, err)
+	}
+	return &regexFilter{re}, nil
+}
+
+func (f *regexFilter) Match(name string) bool {
+	return f.re.MatchString(name)
+}
+
+func (f *regexFilter) String() string {
+	return f.re.String()
+}
+
+// matchAny returns true when one of the filters matches
+func matchAny(filters []Filter, name string) bool {
+	for _, filter := range filters {
+		if filter.Match(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package sender
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNewGlobFilter(t *testing.T) {
+	f, err := NewGlobFilter("*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{
+		"report.csv":       true,
+		"host1/report.csv": true,
+		"report.csv.tmp":   false,
+		"report.txt":       false,
+	} {
+		if f.Match(name) != expected {
+			t.Fatalf("glob %s on %s should be %v", f, name, expected)
+		}
+	}
+
+	f, err = NewGlobFilter("host1/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match("host1/report.csv") || f.Match("host2/report.csv") {
+		t.Fatal("glob with separator should match the relative path")
+	}
+
+	if _, err := NewGlobFilter("[invalid"); err == nil {
+		t.Fatal("invalid pattern should fail")
+	}
+}
+
+func TestNewRegexFilter(t *testing.T) {
+	f, err := NewRegexFilter(`^spool-\d+$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Match("spool-123") || f.Match("spool-abc") || f.Match("host1/spool-123") {
+		t.Fatal("regex should match the full relative path")
+	}
+
+	if _, err := NewRegexFilter("(invalid"); err == nil {
+		t.Fatal("invalid expression should fail")
+	}
+}
+
+func TestFileReader_Filters(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	writeFile(t, spool, "report.csv", TestContent)
+	writeFile(t, spool, "other.csv", TestContent)
+	writeFile(t, spool, "metrics.txt", TestContent)
+	writeFile(t, path.Join(spool, "directory"), "nested.csv", TestContent)
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Recursive = true
+
+	glob, _ := NewGlobFilter("*.csv")
+	r.Include = []Filter{glob}
+
+	names := readNames(t, r)
+	if len(names) != 3 || !names["report.csv"] || !names["other.csv"] || !names["directory/nested.csv"] {
+		t.Fatalf("only included files should be listed: %v", names)
+	}
+
+	regex, _ := NewRegexFilter(`^other`)
+	r.Exclude = []Filter{regex}
+
+	names = readNames(t, r)
+	if len(names) != 2 || names["other.csv"] {
+		t.Fatalf("excluded files should not be listed: %v", names)
+	}
+
+	r.Include = nil
+	names = readNames(t, r)
+	if len(names) != FixtureFiles+3 || names["other.csv"] {
+		t.Fatalf("all files but excluded should be listed: %v", names)
+	}
+
+	spoolGlob, _ := NewGlobFilter("spool-*")
+	r.Include = []Filter{spoolGlob, glob}
+	for name := range readNames(t, r) {
+		if !strings.HasPrefix(name, "spool-") && !strings.HasSuffix(name, ".csv") {
+			t.Fatalf("file should not be included: %s", name)
+		}
+	}
+}
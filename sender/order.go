@@ -0,0 +1,70 @@
+package sender
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Orders in which files are sent
+const (
+	// OrderName sends files sorted by their relative path
+	OrderName = "name"
+	// OrderOldest sends files by modification time, oldest first
+	OrderOldest = "oldest"
+	// OrderSmallest sends files by size, smallest first
+	OrderSmallest = "smallest"
+)
+
+// ValidateOrder checks the name of an order, empty defaults to OrderName
+func ValidateOrder(order string) error {
+	switch order {
+	case "", OrderName, OrderOldest, OrderSmallest:
+		return nil
+	default:
+		return fmt.Errorf("unknown order: %s", order)
+	}
+}
+
+// fileOrder compares files by their priority first, and the order within the same priority
+type fileOrder struct {
+	order string
+	// prefixes of names or subdirectories that are sent first, in the order given
+	priorities []string
+}
+
+// priority returns the index of the first matching prefix, files without a match come last
+func (o fileOrder) priority(name string) int {
+	for i, prefix := range o.priorities {
+		if strings.HasPrefix(name, prefix) || strings.HasPrefix(path.Base(name), prefix) {
+			return i
+		}
+	}
+	return len(o.priorities)
+}
+
+func (o fileOrder) less(a, b *FileData) bool {
+	if pa, pb := o.priority(a.Name()), o.priority(b.Name()); pa != pb {
+		return pa < pb
+	}
+
+	switch o.order {
+	case OrderOldest:
+		if !a.ModTime().Equal(b.ModTime()) {
+			return a.ModTime().Before(b.ModTime())
+		}
+	case OrderSmallest:
+		if a.Size() != b.Size() {
+			return a.Size() < b.Size()
+		}
+	}
+
+	return a.Name() < b.Name()
+}
+
+func (o fileOrder) sort(files []*FileData) {
+	sort.Slice(files, func(i, j int) bool {
+		return o.less(files[i], files[j])
+	})
+}
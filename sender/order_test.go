@@ -0,0 +1,105 @@
+package sender
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func orderedNames(t *testing.T, r *FileReader) []string {
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+
+	return names
+}
+
+func expectOrder(t *testing.T, names []string, expected ...string) {
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestFileReader_Order(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	// only look at the files of this test
+	glob, _ := NewGlobFilter("file-*")
+
+	now := time.Now()
+	for i, name := range []string{"file-c", "file-a", "file-b"} {
+		writeFile(t, spool, name, TestContent[:10*(3-i)])
+
+		mtime := now.Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(path.Join(spool, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Include = []Filter{glob}
+
+	expectOrder(t, orderedNames(t, r), "file-a", "file-b", "file-c")
+
+	r.Order = OrderOldest
+	expectOrder(t, orderedNames(t, r), "file-c", "file-a", "file-b")
+
+	r.Order = OrderSmallest
+	expectOrder(t, orderedNames(t, r), "file-b", "file-a", "file-c")
+}
+
+func TestFileReader_Priority(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	writeFile(t, spool, "bulk-dump", TestContent)
+	writeFile(t, spool, "alert-1", TestContent)
+	writeFile(t, path.Join(spool, "directory"), "urgent", TestContent)
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Recursive = true
+	r.Priority = []string{"directory/", "alert-"}
+
+	names := orderedNames(t, r)
+	if len(names) != FixtureFiles+3 {
+		t.Fatalf("unexpected files: %v", names)
+	}
+
+	expectOrder(t, names[:3], "directory/urgent", "alert-1", "bulk-dump")
+}
+
+func TestValidateOrder(t *testing.T) {
+	for _, order := range []string{"", OrderName, OrderOldest, OrderSmallest} {
+		if err := ValidateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ValidateOrder("random"); err == nil {
+		t.Fatal("unknown order should fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package sender
+
+import (
+	"os"
+)
+
+// fileOwnerIds is not supported on this platform
+func fileOwnerIds(_ os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
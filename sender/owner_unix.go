@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sender
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwnerIds returns uid and gid from the stat of a file
+func fileOwnerIds(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
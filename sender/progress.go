@@ -0,0 +1,282 @@
+package sender
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/lazyfrosch/filespooler/util"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressFile is the default name of the progress journal inside the spool, ReadDir skips it as a dot file
+const ProgressFile = ".filespooler-progress"
+
+// DefaultProgressRetention is the default time the destinations of a file are remembered
+const DefaultProgressRetention = 7 * 24 * time.Hour
+
+// progressCompactLines is the number of lines written beyond the live entries, before the journal is compacted
+const progressCompactLines = 1000
+
+// progressForgotten marks the line of a file that is done, in place of a destination
+const progressForgotten = "-"
+
+// Progress tracks which destinations have a file, when every file is sent to several receivers.
+//
+// A file is only done when Quorum destinations acknowledged it. Every acknowledgement is appended as a line
+// to a file, and synced before the file can be removed, so a restarted sender does not send it again:
+//
+//	<unix time> <progress key> <destination>
+//
+// Once the file is done, a line with "-" as destination forgets it. Entries older than Retention are dropped
+// when the file is compacted.
+type Progress struct {
+	log          *util.AppendLog
+	destinations int
+	entries      map[string]*progressEntry
+	mu           sync.Mutex
+	// lines written since the last compaction
+	lines int
+	// Quorum is the number of destinations that must have a file before it is done, 0 for all destinations
+	Quorum int
+	// Retention is the time destinations of a file are remembered
+	Retention time.Duration
+}
+
+type progressEntry struct {
+	// time of the first acknowledgement
+	time         time.Time
+	destinations map[string]bool
+	// set while the file is removed from the spool
+	claimed bool
+}
+
+func NewProgress(path string, destinations int) *Progress {
+	return &Progress{
+		log:          util.NewAppendLog(path),
+		destinations: destinations,
+		entries:      make(map[string]*progressEntry),
+		Retention:    DefaultProgressRetention,
+	}
+}
+
+// progressKey identifies the content of a file in the spool, a file written again under the same name gets a new key
+func progressKey(file *FileData) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%d\x00%d", file.Name(), file.Size(), file.ModTime().UnixNano())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Open loads the journal from disk and drops expired entries
+func (p *Progress) Open() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.log.Load(func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			// a line might be incomplete after a crash
+			return
+		}
+
+		ts, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return
+		}
+
+		if fields[2] == progressForgotten {
+			delete(p.entries, fields[1])
+		} else {
+			p.add(fields[1], fields[2], time.Unix(ts, 0))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.compact()
+}
+
+func (p *Progress) add(key, destination string, ts time.Time) *progressEntry {
+	entry, ok := p.entries[key]
+	if !ok {
+		entry = &progressEntry{time: ts, destinations: make(map[string]bool)}
+		p.entries[key] = entry
+	}
+
+	entry.destinations[destination] = true
+
+	return entry
+}
+
+// compact rewrites the journal without expired entries
+func (p *Progress) compact() error {
+	now := time.Now()
+
+	err := p.log.Rewrite(func(w io.Writer) {
+		for key, entry := range p.entries {
+			if now.Sub(entry.time) > p.Retention {
+				delete(p.entries, key)
+				continue
+			}
+
+			for destination := range entry.destinations {
+				_, _ = fmt.Fprintf(w, "%d %s %s\n", entry.time.Unix(), key, destination)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	p.lines = 0
+
+	return nil
+}
+
+// write appends a line to the journal, it is synced to disk before returning
+func (p *Progress) write(key, destination string) error {
+	if err := p.log.Append(fmt.Sprintf("%d %s %s", time.Now().Unix(), key, destination)); err != nil {
+		return err
+	}
+
+	p.lines++
+
+	return nil
+}
+
+// quorum returns the number of destinations needed for a file to be done
+func (p *Progress) quorum() int {
+	if p.Quorum <= 0 || p.Quorum > p.destinations {
+		return p.destinations
+	}
+	return p.Quorum
+}
+
+// Pending returns true when a file still has to be sent to destination
+func (p *Progress) Pending(destination, key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[key]
+	return !ok || !entry.claimed && !entry.destinations[destination]
+}
+
+// Add records that destination has a file, and returns true when the caller has to finish it.
+//
+// This is the case once the quorum is reached, and only for one caller, see Claim.
+func (p *Progress) Add(destination, key string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.write(key, destination); err != nil {
+		return false, err
+	}
+
+	p.add(key, destination, time.Now())
+
+	return p.claim(key), nil
+}
+
+// Claim returns true when enough destinations have a file, and nobody else is finishing it.
+//
+// The caller has to remove the file from the spool, and call Forget or Release afterwards.
+func (p *Progress) Claim(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.claim(key)
+}
+
+func (p *Progress) claim(key string) bool {
+	entry, ok := p.entries[key]
+	if !ok || entry.claimed || len(entry.destinations) < p.quorum() {
+		return false
+	}
+
+	entry.claimed = true
+
+	return true
+}
+
+// Release gives up a claim, when the file could not be removed
+func (p *Progress) Release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry, ok := p.entries[key]; ok {
+		entry.claimed = false
+	}
+}
+
+// Forget removes a file that is done
+func (p *Progress) Forget(key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.write(key, progressForgotten); err != nil {
+		return err
+	}
+
+	delete(p.entries, key)
+
+	// forgotten files only matter for the size of the journal, compact it once in a while
+	if p.lines > len(p.entries)+progressCompactLines {
+		return p.compact()
+	}
+
+	return nil
+}
+
+func (p *Progress) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.log.Close()
+}
+
+// done finishes a file the receiver acknowledged, with Progress only once enough destinations have it
+func (s *Sender) done(file *FileData) error {
+	if s.Progress == nil {
+		return s.reader.Done(file.RawName)
+	}
+
+	key := progressKey(file)
+
+	claimed, err := s.Progress.Add(s.addr, key)
+	if err != nil || !claimed {
+		return err
+	}
+
+	return s.finish(file.RawName, key)
+}
+
+// finish removes a file from the spool, that all required destinations have
+func (s *Sender) finish(name, key string) error {
+	if err := s.reader.Done(name); err != nil {
+		s.Progress.Release(key)
+		return err
+	}
+
+	return s.Progress.Forget(key)
+}
+
+// needed returns true for a file that has not been sent to this destination, it is used as FileReader.Needed.
+//
+// Files that are complete, but still in the spool after an interruption, are finished.
+func (s *Sender) needed(file *FileData) bool {
+	key := progressKey(file)
+
+	if s.Progress.Claim(key) {
+		if err := s.finish(file.RawName, key); err != nil {
+			log.Print(err)
+		}
+		return false
+	}
+
+	return s.Progress.Pending(s.addr, key)
+}
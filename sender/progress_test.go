@@ -0,0 +1,76 @@
+package sender
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filespooler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	progressPath := path.Join(dir, ProgressFile)
+
+	p := NewProgress(progressPath, 3)
+	p.Quorum = 2
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := NewFileData("spool-1")
+	file.SetSize(4)
+	key := progressKey(file)
+
+	if claimed, err := p.Add("a:5664", key); err != nil || claimed {
+		t.Fatalf("file should not be done after one destination: %v", err)
+	}
+
+	if p.Pending("a:5664", key) || !p.Pending("b:5664", key) {
+		t.Fatal("file should only be pending for other destinations")
+	}
+
+	_ = p.Close()
+
+	// progress is kept on disk
+	p = NewProgress(progressPath, 3)
+	p.Quorum = 2
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = p.Close()
+	}()
+
+	if p.Pending("a:5664", key) {
+		t.Fatal("destination should be remembered after reopening")
+	}
+
+	if claimed, err := p.Add("b:5664", key); err != nil || !claimed {
+		t.Fatalf("file should be done after the quorum is reached: %v", err)
+	}
+
+	if p.Claim(key) || p.Pending("c:5664", key) {
+		t.Fatal("file should only be finished once, and not be sent while finishing")
+	}
+
+	p.Release(key)
+
+	if !p.Claim(key) {
+		t.Fatal("released file should be claimed again")
+	}
+
+	if err := p.Forget(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Pending("a:5664", key) {
+		t.Fatal("forgotten file should be pending again")
+	}
+}
@@ -0,0 +1,264 @@
+package sender
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the newest version of the wire protocol spoken by this build
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version of the wire protocol still supported
+	MinProtocolVersion = 1
+
+	// CapabilityChecksum is the prefix for checksum algorithms, e.g. "checksum:sha256"
+	CapabilityChecksum = "checksum:"
+	// CapabilityRecursive allows file names with a relative path, the receiver recreates the directories
+	CapabilityRecursive = "recursive"
+	// CapabilityCompression is the prefix for compression algorithms, e.g. "compress:gzip"
+	CapabilityCompression = "compress:"
+	// CapabilityDedup marks files with a delivery id, the receiver acknowledges files it already has without writing them again
+	CapabilityDedup = "dedup"
+	// CapabilityResume allows to continue interrupted transfers, the sender asks for the offset with RESUME
+	CapabilityResume = "resume"
+	// CapabilityWindow allows multiple files in flight, identified by an id in SEND_FILE and ACK
+	CapabilityWindow = "window"
+)
+
+// Hello is exchanged as the first command on every connection.
+//
+// The sender announces the capabilities it wants to use, the receiver answers with those it agrees to.
+//
+//	HELLO <version> <identity> <capability>,<capability>
+type Hello struct {
+	Version      int
+	Identity     string
+	Capabilities []string
+}
+
+func NewHello(identity string, capabilities []string) *Hello {
+	if identity == "" || strings.ContainsAny(identity, " \t\n") {
+		identity = "unknown"
+	}
+
+	return &Hello{
+		Version:      ProtocolVersion,
+		Identity:     identity,
+		Capabilities: capabilities,
+	}
+}
+
+func ParseHello(line string) (*Hello, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "HELLO" {
+		return nil, fmt.Errorf("invalid HELLO: %s", line)
+	}
+
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol version in HELLO: %s", fields[1])
+	}
+
+	h := &Hello{
+		Version:  version,
+		Identity: fields[2],
+	}
+
+	if fields[3] != "-" {
+		h.Capabilities = strings.Split(fields[3], ",")
+	}
+
+	return h, nil
+}
+
+func (h *Hello) String() string {
+	capabilities := "-"
+	if len(h.Capabilities) > 0 {
+		capabilities = strings.Join(h.Capabilities, ",")
+	}
+
+	return fmt.Sprintf("HELLO %d %s %s", h.Version, h.Identity, capabilities)
+}
+
+func (h *Hello) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Agree answers a HELLO from a peer with the protocol version and capabilities both sides support
+func (h *Hello) Agree(peer *Hello) (*Hello, error) {
+	if peer.Version < MinProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d, need at least %d", peer.Version, MinProtocolVersion)
+	}
+
+	agreed := &Hello{
+		Version:  h.Version,
+		Identity: h.Identity,
+	}
+
+	if peer.Version < agreed.Version {
+		agreed.Version = peer.Version
+	}
+
+	for _, c := range peer.Capabilities {
+		if h.Has(c) {
+			agreed.Capabilities = append(agreed.Capabilities, c)
+		}
+	}
+
+	return agreed, nil
+}
+
+// NewTransferId identifies a file by its name, size and checksum, so a partial upload is only continued
+// for the same content
+func NewTransferId(file *FileData) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%d\x00%s\x00", file.Name(), file.Size(), file.ChecksumType())
+	_, _ = h.Write(file.Checksum())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidTransferId checks the format of a transfer id, it is used as a file name by the receiver
+func ValidTransferId(id string) bool {
+	return validId(id)
+}
+
+// NewDeliveryId identifies a file of a sender, it stays the same when the file is sent again after a crash
+func NewDeliveryId(identity string, file *FileData) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%s\x00",
+		identity, file.Name(), file.Size(), file.ModTime().UnixNano(), file.ChecksumType())
+	_, _ = h.Write(file.Checksum())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidDeliveryId checks the format of a delivery id
+func ValidDeliveryId(id string) bool {
+	return validId(id)
+}
+
+// validId checks for a lower case hex encoded sha256 sum
+func validId(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
+
+// FormatOffset answers RESUME with the number of bytes the receiver already has.
+//
+//	RESUME <transfer id>
+//	OFFSET <bytes>
+func FormatOffset(offset int64) string {
+	return "OFFSET " + strconv.FormatInt(offset, 10)
+}
+
+// ParseOffset parses the answer to RESUME, an ERR response is returned as ResponseError
+func ParseOffset(line string) (int64, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "OFFSET ") {
+		if err := ParseResponse(line); err != nil {
+			return 0, err
+		}
+		return 0, NewResponseError(ErrorProtocol, "unexpected response: %s", line)
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimPrefix(line, "OFFSET "), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, NewResponseError(ErrorProtocol, "invalid offset: %s", line)
+	}
+
+	return offset, nil
+}
+
+// Error classes sent by the receiver in ERR responses, the sender decides how to handle a file based on them
+const (
+	ErrorDiskFull     = "disk_full"
+	ErrorPermission   = "permission"
+	ErrorNameRejected = "name_rejected"
+	ErrorChecksum     = "checksum"
+	ErrorQuota        = "quota"
+	ErrorExists       = "exists"
+	ErrorProtocol     = "protocol"
+	ErrorInternal     = "internal"
+)
+
+// ResponseError is the error reported by the receiver.
+//
+//	ERR <class> <message>
+type ResponseError struct {
+	Class   string
+	Message string
+}
+
+func NewResponseError(class string, format string, a ...interface{}) *ResponseError {
+	return &ResponseError{Class: class, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *ResponseError) Error() string {
+	return e.Class + ": " + e.Message
+}
+
+// String formats the error as a single response line
+func (e *ResponseError) String() string {
+	message := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, e.Message)
+
+	return "ERR " + e.Class + " " + message
+}
+
+// ParseResponse parses an answer of the receiver, returns nil for OK or a ResponseError
+func ParseResponse(line string) error {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "OK" {
+		return nil
+	}
+
+	if !strings.HasPrefix(line, "ERR ") {
+		return NewResponseError(ErrorProtocol, "unexpected response: %s", line)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(line, "ERR "), " ", 2)
+	e := &ResponseError{Class: parts[0]}
+	if len(parts) > 1 {
+		e.Message = parts[1]
+	}
+
+	return e
+}
+
+// FormatAck prefixes a response with the id of the file it belongs to, used with CapabilityWindow.
+//
+//	ACK <id> OK
+//	ACK <id> ERR <class> <message>
+func FormatAck(id uint64, response string) string {
+	return "ACK " + strconv.FormatUint(id, 10) + " " + response
+}
+
+// ParseAck splits an ACK line into the id of the file and the response
+func ParseAck(line string) (uint64, string, error) {
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(parts) != 3 || parts[0] != "ACK" {
+		return 0, "", NewResponseError(ErrorProtocol, "invalid ACK: %s", line)
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", NewResponseError(ErrorProtocol, "invalid id in ACK: %s", parts[1])
+	}
+
+	return id, parts[2], nil
+}
@@ -0,0 +1,159 @@
+package sender
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	h := NewHello("sender.example.com", []string{"checksum:sha256", "other"})
+
+	line := h.String()
+	if line != "HELLO 1 sender.example.com checksum:sha256,other" {
+		t.Fatalf("unexpected HELLO line: %s", line)
+	}
+
+	parsed, err := ParseHello(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Version != ProtocolVersion || parsed.Identity != h.Identity || len(parsed.Capabilities) != 2 {
+		t.Fatalf("parsed HELLO does not match: %v", parsed)
+	}
+
+	empty, err := ParseHello(NewHello("", nil).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Identity != "unknown" || len(empty.Capabilities) != 0 {
+		t.Fatalf("parsed HELLO does not match: %v", empty)
+	}
+}
+
+func TestParseHello_Invalid(t *testing.T) {
+	for _, line := range []string{"", "HELLO", "HELLO x sender -", "HELO 1 sender -", "HELLO 1 sender - extra"} {
+		if _, err := ParseHello(line); err == nil {
+			t.Fatalf("parsing should fail for: %q", line)
+		}
+	}
+}
+
+func TestHello_Agree(t *testing.T) {
+	receiver := NewHello("receiver", []string{"checksum:sha256", "checksum:md5"})
+	peer := NewHello("sender", []string{"checksum:sha512", "checksum:sha256"})
+
+	agreed, err := receiver.Agree(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agreed.Identity != "receiver" || len(agreed.Capabilities) != 1 || !agreed.Has("checksum:sha256") {
+		t.Fatalf("unexpected agreement: %v", agreed)
+	}
+
+	peer.Version = MinProtocolVersion - 1
+	if _, err := receiver.Agree(peer); err == nil {
+		t.Fatal("agreeing to an old protocol version should fail")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	if err := ParseResponse("OK\n"); err != nil {
+		t.Fatalf("OK should not be an error: %s", err)
+	}
+
+	err := ParseResponse(NewResponseError(ErrorDiskFull, "no space\nleft on %s", "/data").String() + "\n")
+	if e, ok := err.(*ResponseError); !ok || e.Class != ErrorDiskFull || e.Message != "no space left on /data" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = ParseResponse("ERR")
+	if e, ok := err.(*ResponseError); !ok || e.Class != ErrorProtocol {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = ParseResponse("ERR internal")
+	if e, ok := err.(*ResponseError); !ok || e.Class != ErrorInternal || e.Message != "" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParseAck(t *testing.T) {
+	line := FormatAck(42, NewResponseError(ErrorChecksum, "mismatch").String())
+
+	id, response, err := ParseAck(line + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != 42 || response != "ERR checksum mismatch" {
+		t.Fatalf("unexpected ACK: %d %s", id, response)
+	}
+
+	for _, invalid := range []string{"OK", "ACK 42", "ACK x OK", "ACK -1 OK"} {
+		if _, _, err := ParseAck(invalid); err == nil {
+			t.Fatalf("parsing should fail for %q", invalid)
+		}
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	offset, err := ParseOffset(FormatOffset(1024) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 1024 {
+		t.Fatalf("unexpected offset %d", offset)
+	}
+
+	_, err = ParseOffset("ERR internal transfer is still in progress")
+	if e, ok := err.(*ResponseError); !ok || e.Class != ErrorInternal {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, invalid := range []string{"OK", "OFFSET", "OFFSET x", "OFFSET -1"} {
+		if _, err := ParseOffset(invalid); err == nil {
+			t.Fatalf("parsing should fail for %q", invalid)
+		}
+	}
+}
+
+func TestTransferId(t *testing.T) {
+	file := NewFileData("spool-1")
+	file.SetSize(3)
+	file.SetChecksum("sha256", []byte{1, 2, 3})
+
+	id := NewTransferId(file)
+	if !ValidTransferId(id) {
+		t.Fatalf("transfer id should be valid: %s", id)
+	}
+
+	file.SetChecksum("sha256", []byte{1, 2, 4})
+	if NewTransferId(file) == id {
+		t.Fatal("transfer id should change with the content")
+	}
+
+	for _, invalid := range []string{"", "abc", "../" + id[3:], strings.ToUpper(id)} {
+		if ValidTransferId(invalid) {
+			t.Fatalf("transfer id should be invalid: %q", invalid)
+		}
+	}
+}
+
+func TestDeliveryId(t *testing.T) {
+	file := NewFileData("spool-1")
+	file.SetSize(3)
+
+	id := NewDeliveryId("sender1", file)
+	if !ValidDeliveryId(id) {
+		t.Fatalf("delivery id should be valid: %s", id)
+	}
+
+	if NewDeliveryId("sender1", file) != id {
+		t.Fatal("delivery id should be the same when the file is sent again")
+	}
+	if NewDeliveryId("sender2", file) == id {
+		t.Fatal("delivery id should differ between senders")
+	}
+}
@@ -2,17 +2,67 @@ package sender
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/user"
 	"path"
+	"strconv"
+	"time"
 )
 
+// QuarantineDir is the directory inside the spool where files are moved that can not be delivered
+const QuarantineDir = "failed"
+
+// QuarantineErrorSuffix is the suffix of the file next to a quarantined file, that holds the last error
+const QuarantineErrorSuffix = ".error"
+
+// ScanChunkSize is the number of directory entries read at once
+const ScanChunkSize = 1000
+
+// DefaultBatchFiles is the default limit for files sent before the spool is checked again
+const DefaultBatchFiles = 1000
+
 type FileReader struct {
 	path string
+	// Recursive includes files in subdirectories, which are removed when they are empty after sending
+	Recursive bool
+	// Owner includes uid and gid, and their names, with every file
+	Owner bool
+	// Readiness defines when a file is completely written, by default every file is ready
+	Readiness Readiness
+	// Include selects files to send, when empty all files are included
+	Include []Filter
+	// Exclude skips files, even when they are included
+	Exclude []Filter
+	// Order in which files are sent, see OrderName, OrderOldest and OrderSmallest
+	Order string
+	// Priority lists prefixes of names or subdirectories, matching files are sent before all others
+	Priority []string
+	// BatchFiles limits the number of files returned by ReadDir, 0 is unlimited
+	BatchFiles int
+	// BatchBytes limits the total size of files returned by ReadDir, 0 is unlimited
+	BatchBytes int64
+	// Archive is the directory files are moved to after sending, instead of deleting them.
+	// A relative path is inside the spool.
+	Archive string
+	// ArchiveBucket is a time layout for subdirectories in the archive, see ArchiveBuckets
+	ArchiveBucket string
+	// Needed skips files when it returns false, before they count towards BatchFiles and BatchBytes
+	Needed func(file *FileData) bool
+	users  map[int]string
+	groups map[int]string
+	state  *scanState
 }
 
 func NewFileReader(path string) (*FileReader, error) {
-	w := FileReader{path}
+	w := FileReader{
+		path:   path,
+		users:  make(map[int]string),
+		groups: make(map[int]string),
+		state:  newScanState(),
+	}
 	stat, err := os.Stat(w.path)
 	if err != nil {
 		return nil, fmt.Errorf("could not stat source directory: %s", err.Error())
@@ -25,42 +75,197 @@ func NewFileReader(path string) (*FileReader, error) {
 	return &w, nil
 }
 
+// Clone returns a reader with the same settings, and its own state of the spool.
+//
+// Senders for different destinations use their own reader, so they can check the spool at the same time.
+func (r FileReader) Clone() *FileReader {
+	c := r
+	c.users = make(map[int]string)
+	c.groups = make(map[int]string)
+	c.state = newScanState()
+	return &c
+}
+
+// ReadDir lists the spool and returns the headers of files, content is only read when the file is opened
+//
+// In recursive mode files in subdirectories are named by their path relative to the spool.
+//
+// Files that are not ready yet, according to Readiness, are skipped and counted by Pending.
+//
+// Files are returned by Priority first, and then sorted by Order. When BatchFiles or BatchBytes are set,
+// only the first files within those limits are returned, and More reports that the spool has more files.
+// The directory is read in chunks, so memory stays bounded for huge spools.
 func (r FileReader) ReadDir() ([]*FileData, error) {
-	files, err := ioutil.ReadDir(r.path)
+	r.state.begin()
+
+	b := &batch{
+		order:    fileOrder{r.Order, r.Priority},
+		maxFiles: r.BatchFiles,
+		maxBytes: r.BatchBytes,
+	}
+
+	if err := r.readDir("", b); err != nil {
+		return nil, err
+	}
+
+	r.state.finish()
+	r.state.more = b.truncated
+
+	return b.sorted(), nil
+}
+
+// Pending returns the number of files that were not ready during the last ReadDir
+func (r FileReader) Pending() int {
+	return r.state.pending
+}
+
+// More returns true when the last ReadDir was limited by the batch size
+func (r FileReader) More() bool {
+	return r.state.more
+}
+
+// Skip excludes a file from ReadDir, until the reader is recreated
+func (r FileReader) Skip(name string) {
+	r.state.skip(name)
+}
+
+func (r FileReader) readDir(dir string, b *batch) error {
+	d, err := os.Open(path.Join(r.path, dir))
 	if err != nil {
-		return nil, fmt.Errorf("could not open directory: %s", err)
+		return fmt.Errorf("could not open directory: %s", err)
 	}
 
-	var spool []*FileData
-	for _, file := range files {
-		name := file.Name()
-		if file.IsDir() || name[0:1] == "." {
-			continue
+	defer func() {
+		_ = d.Close()
+	}()
+
+	for {
+		files, err := d.Readdir(ScanChunkSize)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read directory: %s", err)
 		}
 
-		f, err := r.ReadFile(name)
-		if err != nil {
-			return nil, err
+		for _, file := range files {
+			if err := r.readEntry(dir, file, b); err != nil {
+				return err
+			}
 		}
+	}
+}
 
-		spool = append(spool, f)
+func (r FileReader) readEntry(dir string, file os.FileInfo, b *batch) error {
+	name := file.Name()
+	if name[0:1] == "." {
+		return nil
 	}
 
-	return spool, nil
+	relPath := path.Join(dir, name)
+
+	if file.IsDir() {
+		if !r.Recursive || relPath == QuarantineDir || r.isArchive(relPath) {
+			return nil
+		}
+
+		return r.readDir(relPath, b)
+	}
+
+	if r.state.isSkipped(relPath) || r.Readiness.isMarker(name) || r.Readiness.isIgnored(name) || !r.isSelected(relPath) {
+		return nil
+	}
+
+	if !r.Readiness.isReady(r.path, relPath, file, r.state) {
+		r.state.pending++
+		return nil
+	}
+
+	f := r.newFileData(relPath, file)
+	if r.Needed != nil && !r.Needed(f) {
+		return nil
+	}
+
+	b.add(f)
+
+	return nil
+}
+
+// isSelected applies the include and exclude filters to a file
+func (r FileReader) isSelected(name string) bool {
+	if len(r.Include) > 0 && !matchAny(r.Include, name) {
+		return false
+	}
+
+	return !matchAny(r.Exclude, name)
 }
 
 func (r FileReader) ReadFile(name string) (*FileData, error) {
 	filePath := path.Join(r.path, name)
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat file %s: %s", filePath, err)
+	}
+
+	return r.newFileData(name, info), nil
+}
+
+func (r FileReader) newFileData(name string, info os.FileInfo) *FileData {
 	f := NewFileData(name)
+	f.SetFileInfo(info)
+
+	if r.Owner {
+		f.SetOwner(r.lookupOwner(info))
+	}
 
-	content, err := ioutil.ReadFile(filePath)
+	return f
+}
+
+// lookupOwner resolves the owner of a file, names are cached since most files share the same owner
+func (r FileReader) lookupOwner(info os.FileInfo) *FileOwner {
+	uid, gid, ok := fileOwnerIds(info)
+	if !ok {
+		return nil
+	}
+
+	owner := &FileOwner{Uid: uid, Gid: gid}
+
+	var found bool
+	if owner.User, found = r.users[uid]; !found {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			owner.User = u.Username
+		}
+		r.users[uid] = owner.User
+	}
+
+	if owner.Group, found = r.groups[gid]; !found {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			owner.Group = g.Name
+		}
+		r.groups[gid] = owner.Group
+	}
+
+	return owner
+}
+
+// Open opens the file for streaming and updates the size of the header with the current state on disk
+func (r FileReader) Open(f *FileData) (*os.File, error) {
+	filePath := path.Join(r.path, f.Name())
+
+	fh, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %s: %s", filePath, err)
+	}
+
+	info, err := fh.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("could not read from file: %s", filePath)
+		_ = fh.Close()
+		return nil, fmt.Errorf("could not stat file %s: %s", filePath, err)
 	}
 
-	f.SetContent(content)
+	f.SetFileInfo(info)
 
-	return f, nil
+	return fh, nil
 }
 
 func (r FileReader) Delete(name string) error {
@@ -71,5 +276,72 @@ func (r FileReader) Delete(name string) error {
 		return fmt.Errorf("could not remove file %s: %s", filePath, err)
 	}
 
+	r.removeMarker(name)
+
+	if r.Recursive {
+		r.pruneDirs(path.Dir(name))
+	}
+
+	return nil
+}
+
+// removeMarker removes the companion file that marked a file as ready
+func (r FileReader) removeMarker(name string) {
+	if r.Readiness.ReadyMarker == "" {
+		return
+	}
+
+	markerPath := path.Join(r.path, name+r.Readiness.ReadyMarker)
+	if err := os.Remove(markerPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("could not remove ready marker %s: %s", markerPath, err)
+	}
+}
+
+// pruneDirs removes dir and its parents inside the spool, as long as they are empty
+func (r FileReader) pruneDirs(dir string) {
+	for dir != "." && dir != "/" && dir != "" {
+		if err := os.Remove(path.Join(r.path, dir)); err != nil {
+			// not empty or already gone
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// Quarantine moves a file out of the spool into QuarantineDir, keeping its relative path
+func (r FileReader) Quarantine(name string) error {
+	target := path.Join(r.path, QuarantineDir, name)
+	dir := path.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create quarantine directory %s: %s", dir, err)
+	}
+
+	filePath := path.Join(r.path, name)
+	if err := os.Rename(filePath, target); err != nil {
+		return fmt.Errorf("could not move file %s to quarantine: %s", filePath, err)
+	}
+
+	r.removeMarker(name)
+
+	if r.Recursive {
+		r.pruneDirs(path.Dir(name))
+	}
+
+	return nil
+}
+
+// QuarantineWithError moves a file to QuarantineDir, and writes the reason next to it
+func (r FileReader) QuarantineWithError(name string, reason string) error {
+	if err := r.Quarantine(name); err != nil {
+		return err
+	}
+
+	errorPath := path.Join(r.path, QuarantineDir, name+QuarantineErrorSuffix)
+	content := time.Now().Format(time.RFC3339) + " " + reason + "\n"
+
+	if err := ioutil.WriteFile(errorPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("could not write error for quarantined file %s: %s", name, err)
+	}
+
 	return nil
 }
@@ -80,11 +80,25 @@ func TestNewFileReader(t *testing.T) {
 	}
 
 	for _, file := range files {
-		if len(file.Content()) == 0 {
-			t.Fatalf("File RawContent is empty: %s", file.RawName)
+		if file.Size() == 0 {
+			t.Fatalf("File size is empty: %s", file.RawName)
 		}
 
-		err := r.Delete(file.RawName)
+		fh, err := r.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(fh)
+		_ = fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(content)) != file.Size() {
+			t.Fatalf("Read %d bytes from %s, expected %d", len(content), file.RawName, file.Size())
+		}
+
+		err = r.Delete(file.RawName)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -103,3 +117,157 @@ func TestNewFileReader(t *testing.T) {
 		t.Fatal("Found left over file: ", file.Name())
 	}
 }
+
+func TestFileReader_Quarantine(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := files[0].Name()
+	if err := r.Quarantine(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(spool, QuarantineDir, name)); err != nil {
+		t.Fatal("file should be in quarantine: ", err)
+	}
+
+	files, err = r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != FixtureFiles-1 {
+		t.Fatalf("quarantined file should not be listed anymore, found %d files", len(files))
+	}
+}
+
+func TestFileReader_Recursive(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	_ = os.MkdirAll(path.Join(spool, "host1", "2019"), 0755)
+	_ = os.MkdirAll(path.Join(spool, QuarantineDir), 0755)
+	writeFile(t, path.Join(spool, "host1"), "spool-1", TestContent)
+	writeFile(t, path.Join(spool, "host1", "2019"), "spool-2", TestContent)
+	writeFile(t, path.Join(spool, QuarantineDir), "spool-3", TestContent)
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != FixtureFiles {
+		t.Fatalf("subdirectories should be ignored by default, found %d files", len(files))
+	}
+
+	r.Recursive = true
+
+	files, err = r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != FixtureFiles+2 {
+		t.Fatalf("expected %d files in recursive mode, found %d", FixtureFiles+2, len(files))
+	}
+
+	for _, name := range []string{"host1/spool-1", "host1/2019/spool-2"} {
+		if err := r.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(spool, "host1")); !os.IsNotExist(err) {
+		t.Fatal("empty directories should be removed after delete")
+	}
+	if _, err := os.Stat(path.Join(spool, "directory")); err != nil {
+		t.Fatal("unrelated empty directories should be kept")
+	}
+}
+
+func TestFileReader_Batch(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.BatchFiles = 4
+
+	seen := make(map[string]bool)
+
+	for i, expected := range []int{4, 4, 2} {
+		files, err := r.ReadDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != expected {
+			t.Fatalf("batch %d has %d files, expected %d", i, len(files), expected)
+		}
+		if r.More() != (i < 2) {
+			t.Fatalf("More should be %v for batch %d", i < 2, i)
+		}
+
+		for _, file := range files {
+			if seen[file.Name()] {
+				t.Fatalf("file %s was listed twice", file.Name())
+			}
+			seen[file.Name()] = true
+
+			if err := r.Delete(file.Name()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(seen) != FixtureFiles {
+		t.Fatalf("expected all %d files to be listed, got %d", FixtureFiles, len(seen))
+	}
+}
+
+func TestFileReader_Skip(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Skip(files[0].Name())
+
+	files, err = r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != FixtureFiles-1 {
+		t.Fatalf("skipped file should not be listed, found %d files", len(files))
+	}
+}
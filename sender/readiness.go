@@ -0,0 +1,112 @@
+package sender
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Readiness decides when a file has been completely written by its producer and can be sent
+type Readiness struct {
+	// MinAge is the minimum time since the last modification
+	MinAge time.Duration
+	// StableSize requires size and modification time to be unchanged between two checks
+	StableSize bool
+	// IgnoreSuffixes lists suffixes of files that are still being written, like ".tmp" or ".part"
+	IgnoreSuffixes []string
+	// ReadyMarker is the suffix of a companion file that must exist before a file is sent, like ".ready"
+	ReadyMarker string
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// scanState keeps track of files between checks of the spool
+type scanState struct {
+	// files seen by the previous check
+	files map[string]fileState
+	// files seen by the running check
+	next map[string]fileState
+	// number of files that were not ready during the last check
+	pending int
+	// set when the last check returned a limited batch
+	more bool
+	// files that are never listed again, can be changed by parallel workers
+	skipped map[string]bool
+	mu      sync.Mutex
+}
+
+func newScanState() *scanState {
+	return &scanState{
+		files:   make(map[string]fileState),
+		skipped: make(map[string]bool),
+	}
+}
+
+func (s *scanState) begin() {
+	s.next = make(map[string]fileState)
+	s.pending = 0
+}
+
+func (s *scanState) skip(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skipped[name] = true
+}
+
+func (s *scanState) isSkipped(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.skipped[name]
+}
+
+// finish replaces the previous state, so files that are gone are forgotten
+func (s *scanState) finish() {
+	s.files = s.next
+	s.next = nil
+}
+
+// isMarker returns true for companion files that are never sent themselves
+func (c Readiness) isMarker(name string) bool {
+	return c.ReadyMarker != "" && strings.HasSuffix(name, c.ReadyMarker)
+}
+
+func (c Readiness) isIgnored(name string) bool {
+	for _, suffix := range c.IgnoreSuffixes {
+		if suffix != "" && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReady checks a file of the current listing, name is relative to the spool at root
+func (c Readiness) isReady(root string, name string, info os.FileInfo, state *scanState) bool {
+	if c.ReadyMarker != "" {
+		if _, err := os.Lstat(path.Join(root, name+c.ReadyMarker)); err != nil {
+			return false
+		}
+	}
+
+	if c.MinAge > 0 && time.Since(info.ModTime()) < c.MinAge {
+		return false
+	}
+
+	if c.StableSize {
+		current := fileState{size: info.Size(), modTime: info.ModTime()}
+		previous, seen := state.files[name]
+		state.next[name] = current
+
+		if !seen || previous != current {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,146 @@
+package sender
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func readNames(t *testing.T, r *FileReader) map[string]bool {
+	files, err := r.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+
+	return names
+}
+
+func TestReadiness_IgnoreSuffixes(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	writeFile(t, spool, "upload.part", TestContent)
+	writeFile(t, spool, "dump.tmp", TestContent)
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Readiness.IgnoreSuffixes = []string{".tmp", ".part"}
+
+	names := readNames(t, r)
+	if len(names) != FixtureFiles || names["upload.part"] || names["dump.tmp"] {
+		t.Fatalf("files with ignored suffixes should be skipped: %v", names)
+	}
+	if r.Pending() != 0 {
+		t.Fatal("ignored files should not be pending")
+	}
+}
+
+func TestReadiness_ReadyMarker(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	writeFile(t, spool, "data-1", TestContent)
+	writeFile(t, spool, "data-1.ready", "")
+	writeFile(t, spool, "data-2", TestContent)
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Readiness.ReadyMarker = ".ready"
+
+	names := readNames(t, r)
+	if len(names) != 1 || !names["data-1"] {
+		t.Fatalf("only files with marker should be ready: %v", names)
+	}
+	if r.Pending() != FixtureFiles+1 {
+		t.Fatalf("files without marker should be pending, got %d", r.Pending())
+	}
+
+	if err := r.Delete("data-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(spool, "data-1.ready")); !os.IsNotExist(err) {
+		t.Fatal("marker should be removed with the file")
+	}
+}
+
+func TestReadiness_MinAge(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	writeFile(t, spool, "fresh", TestContent)
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Readiness.MinAge = time.Minute
+
+	// all fixture files are fresh at first
+	old := time.Now().Add(-time.Hour)
+	files, err := ioutil.ReadDir(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "fresh" {
+			_ = os.Chtimes(path.Join(spool, file.Name()), old, old)
+		}
+	}
+
+	names := readNames(t, r)
+	if len(names) != FixtureFiles || names["fresh"] {
+		t.Fatalf("fresh files should not be ready: %v", names)
+	}
+	if r.Pending() != 1 {
+		t.Fatalf("fresh file should be pending, got %d", r.Pending())
+	}
+}
+
+func TestReadiness_StableSize(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Readiness.StableSize = true
+
+	if names := readNames(t, r); len(names) != 0 {
+		t.Fatalf("no file should be ready on the first check: %v", names)
+	}
+
+	// growing file
+	writeFile(t, spool, "spool-growing", TestContent)
+	if names := readNames(t, r); len(names) != FixtureFiles {
+		t.Fatalf("all stable files should be ready: %v", names)
+	}
+
+	writeFile(t, spool, "spool-growing", TestContent+TestContent)
+	if names := readNames(t, r); names["spool-growing"] {
+		t.Fatal("growing file should not be ready")
+	}
+
+	if names := readNames(t, r); !names["spool-growing"] {
+		t.Fatal("file should be ready after it stopped growing")
+	}
+}
@@ -1,14 +1,12 @@
 package sender
 
 import (
-	"bufio"
 	"crypto/tls"
-	"encoding/gob"
 	"fmt"
 	"github.com/lazyfrosch/filespooler/util"
 	"log"
-	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,177 +15,501 @@ const (
 	KeepaliveInterval = 10
 	FileCheckInterval = 5
 	DataTimeout       = 5
+	// MinSyncRate is the slowest the receiver is expected to sync a file in bytes per second,
+	// the wait for an acknowledgement is extended by the size of the file
+	MinSyncRate = 16 << 20
+	// RescanInterval is the default for full checks of the spool, when changes are watched for
+	RescanInterval = 60
+	// DefaultWindow is the default number of files in flight
+	DefaultWindow = 16
+	// MaxWindow limits files in flight, so pending acknowledgements always fit into network buffers
+	MaxWindow = 1000
+	// DefaultResumeSize is the default for the minimum size of files that are resumed after an interrupted transfer
+	DefaultResumeSize = 16 << 20
+	// MaxWorkers limits the number of parallel connections to the receiver
+	MaxWorkers = 64
+	// DefaultReconnectMin is the default delay after the first failed connection attempt
+	DefaultReconnectMin = 1 * time.Second
+	// DefaultReconnectMax is the default limit for the delay between connection attempts
+	DefaultReconnectMax = 5 * time.Minute
+	// DefaultReconnectReset is the default time a connection must stay up, before the reconnect backoff is reset
+	DefaultReconnectReset = 60 * time.Second
 )
 
 type Sender struct {
-	addr      string
-	conn      net.Conn
-	reader    *FileReader
-	quit      chan bool
+	// address of the primary receiver
+	addr   string
+	reader *FileReader
+	quit   chan bool
+	// one connection per worker, nil while not connected
+	conns []*connection
+	// index of the receiver connections are opened to, 0 is the primary
+	current int
+	// time of the last failover, or the last check of the primary
+	failedOver time.Time
+	// guards conns, current, failedOver, pausedUntil and failures
+	mu sync.Mutex
+	// no files are sent before this time, set when the receiver asks to back off
+	pausedUntil time.Time
+	// failed attempts per file
+	failures map[string]int
+
 	TlsConfig *tls.Config
-	rw        *bufio.ReadWriter
+	// Checksum is the hash algorithm used to verify each file on the receiver, empty disables verification
+	Checksum string
+	// Identity is announced to the receiver during the handshake
+	Identity string
+	// Watch sends files as soon as they are written, polling is used when watching is not supported
+	Watch bool
+	// RescanInterval is the time between full checks of the spool while watching
+	RescanInterval time.Duration
+	// Window is the number of files sent before waiting for acknowledgements
+	Window int
+	// Compression is the algorithm used for file content when the receiver supports it, empty disables compression
+	Compression string
+	// ResumeSize is the minimum size of files that are continued after an interrupted transfer, 0 disables resuming.
+	// Resuming needs a Checksum, so only the same content is continued.
+	ResumeSize int64
+	// MaxRetries is the number of failed attempts before a file is moved to quarantine, 0 retries forever
+	MaxRetries int
+	// Workers is the number of parallel connections, that share the files of the spool
+	Workers int
+	// ReconnectBackoff is the delay between connection attempts, also after a connection was lost.
+	// It is reset when a file is acknowledged, or a connection stayed up for ReconnectReset.
+	ReconnectBackoff *util.Backoff
+	// ReconnectReset is the time a connection must stay up before the backoff is reset, 0 resets it on every handshake
+	ReconnectReset time.Duration
+	// Failover are further receivers, used when the primary can not be reached
+	Failover []string
+	// FailoverMode is the policy for choosing the next receiver, see FailoverPriority and FailoverRoundRobin
+	FailoverMode string
+	// FailbackInterval is the time between checks whether the primary is available again, 0 stays on the failover
+	FailbackInterval time.Duration
+	// Progress is shared by the senders of all destinations, when every file is sent to several receivers.
+	// A file is only removed from the spool, once enough destinations have it.
+	Progress *Progress
 }
 
 func NewSender(addr string, reader *FileReader) *Sender {
 	return &Sender{
-		addr:   addr,
-		reader: reader,
+		addr:     addr,
+		reader:   reader,
+		quit:     make(chan bool),
+		failures: make(map[string]int),
+		Checksum: DefaultChecksum,
+		Window:   DefaultWindow,
+		Workers:  1,
+
+		ResumeSize: DefaultResumeSize,
+
+		RescanInterval: RescanInterval * time.Second,
+
+		ReconnectBackoff: util.NewBackoff(DefaultReconnectMin, DefaultReconnectMax),
+		ReconnectReset:   DefaultReconnectReset,
+
+		FailoverMode:     FailoverPriority,
+		FailbackInterval: DefaultFailbackInterval,
 	}
 }
 
+// Open connects all workers that are not connected yet, and returns the first error.
+//
+// When the current receiver can not be reached, the workers fail over to the next one in Failover.
 func (s *Sender) Open() error {
-	log.Printf("Connecting to %s", s.addr)
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-	_, err := net.ResolveTCPAddr("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("could not parse address %s: %s", s.addr, err)
+	s.mu.Lock()
+	for len(s.conns) < workers {
+		s.conns = append(s.conns, nil)
 	}
 
-	conn, err := net.DialTimeout("tcp", s.addr, ConnectTimeout*time.Second)
-	if err != nil {
-		return fmt.Errorf("could not connect to %s: %s", s.addr, err)
+	var missing []int
+	for i, c := range s.conns {
+		if c == nil {
+			missing = append(missing, i)
+		}
 	}
+	s.mu.Unlock()
 
-	if s.TlsConfig != nil {
-		var tlsConn *tls.Conn
+	var firstErr error
 
-		err := conn.SetReadDeadline(time.Now().Add(ConnectTimeout * time.Second))
+	// dial without holding the lock, so Status does not block on a slow receiver
+	for _, i := range missing {
+		c, err := s.dialTarget()
 		if err != nil {
-			return fmt.Errorf("could not set deadline: %s", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
 
-		s.TlsConfig.ServerName = util.GetNameFromTCPAddr(s.addr)
+		s.mu.Lock()
+		s.conns[i] = c
+		s.mu.Unlock()
+	}
 
-		tlsConn = tls.Client(conn, s.TlsConfig)
+	return firstErr
+}
 
-		err = tlsConn.Handshake()
-		if err != nil {
-			_ = conn.Close()
-			return fmt.Errorf("TLS Handshake failed: %s", err)
-		}
+// capabilities returns those the receiver has to agree to, and those only used when the receiver supports them
+func (s *Sender) capabilities() ([]string, []string) {
+	var required, optional []string
 
-		s.conn = tlsConn
-	} else {
-		s.conn = conn
+	if s.Checksum != "" {
+		required = append(required, CapabilityChecksum+s.Checksum)
 	}
 
-	s.rw = bufio.NewReadWriter(bufio.NewReader(s.conn), bufio.NewWriter(s.conn))
+	if s.reader.Recursive {
+		required = append(required, CapabilityRecursive)
+	}
 
-	return nil
+	if s.Compression != "" {
+		optional = append(optional, CapabilityCompression+s.Compression)
+	}
+
+	optional = append(optional, CapabilityDedup)
+
+	if s.ResumeSize > 0 && s.Checksum != "" {
+		optional = append(optional, CapabilityResume)
+	}
+
+	if s.Window > 1 {
+		optional = append(optional, CapabilityWindow)
+	}
+
+	return required, optional
 }
 
+// Reconnect opens workers that lost their connection.
+//
+// A failed attempt increases the delay of ReconnectBackoff. A successful handshake only resets it when
+// ReconnectReset is 0, otherwise a receiver that drops connections right after the handshake is not hammered.
 func (s *Sender) Reconnect() {
-	if s.conn != nil {
-		_ = s.conn.Close()
-		s.conn = nil
-		s.rw = nil
+	if err := s.Open(); err != nil {
+		s.connectionFailed(fmt.Sprintf("error connecting to server: %s", err))
+	} else if s.ReconnectReset <= 0 {
+		s.connectionWorks()
 	}
+}
 
-	if err := s.Open(); err != nil {
-		log.Printf("error connecting to server: %s", err)
+// connectionFailed delays the next connection attempt
+func (s *Sender) connectionFailed(reason string) {
+	delay := s.ReconnectBackoff.Failed()
+	log.Printf("%s, retrying in %s (attempt %d)", reason, delay.Round(time.Millisecond), s.ReconnectBackoff.Attempts())
+}
+
+// connectionWorks resets the reconnect backoff, after the receiver acknowledged a file or the connection is stable
+func (s *Sender) connectionWorks() {
+	if attempts := s.ReconnectBackoff.Attempts(); attempts > 0 {
+		log.Printf("Connection to %s works again after %d failed attempts", s.target(), attempts)
+		s.ReconnectBackoff.Reset()
+	}
+}
+
+// needsReconnect returns true when workers are not connected
+func (s *Sender) needsReconnect() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.conns) == 0 {
+		return true
+	}
+
+	for _, c := range s.conns {
+		if c == nil {
+			return true
+		}
 	}
+
+	return false
 }
 
-func (s *Sender) setTimeout() {
-	_ = s.conn.SetDeadline(time.Now().Add(DataTimeout * time.Second))
+// connected returns the open connections
+func (s *Sender) connected() []*connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conns []*connection
+	for _, c := range s.conns {
+		if c != nil {
+			conns = append(conns, c)
+		}
+	}
+	return conns
 }
 
-func (s *Sender) Run() {
-	s.quit = make(chan bool)
+// disconnect closes the connection of a worker after an error
+func (s *Sender) disconnect(c *connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.conns {
+		if s.conns[i] == c {
+			_ = c.close()
+			s.conns[i] = nil
+		}
+	}
+}
+
+// Status describes the connections of the sender, and when the next connection attempt is made
+func (s *Sender) Status() string {
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	target := s.target()
+	status := fmt.Sprintf("%d of %d workers connected to %s", len(s.connected()), workers, target)
+
+	if target != s.addr {
+		status += fmt.Sprintf(", failed over from %s", s.addr)
+	}
+
+	if attempts := s.ReconnectBackoff.Attempts(); attempts > 0 {
+		status += fmt.Sprintf(", %d failed connection attempts, next in %s",
+			attempts, s.ReconnectBackoff.Remaining().Round(time.Second))
+	}
+
+	if s.paused() {
+		status += ", paused by the receiver"
+	}
+
+	return status
+}
+
+func (s *Sender) paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Now().Before(s.pausedUntil)
+}
+
+func (s *Sender) pause(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pausedUntil = time.Now().Add(d)
+}
 
+func (s *Sender) Run() {
 	keepalive := time.NewTicker(KeepaliveInterval * time.Second)
-	checkFiles := time.NewTicker(FileCheckInterval * time.Second)
+	checkInterval := FileCheckInterval * time.Second
+
+	var events <-chan bool
+	if s.Watch {
+		if watcher, err := NewWatcher(s.reader.path, s.reader.Recursive); err != nil {
+			log.Printf("Falling back to polling every %s: %s", checkInterval, err)
+		} else {
+			defer func() {
+				_ = watcher.Close()
+			}()
+
+			events = watcher.Events()
+			checkInterval = s.RescanInterval
+			log.Printf("Watching %s for new files, full check every %s", s.reader.path, checkInterval)
+		}
+	}
+
+	checkFiles := time.NewTicker(checkInterval)
+
+	defer func() {
+		keepalive.Stop()
+		checkFiles.Stop()
+	}()
+
+	// set when files are waiting to become ready while watching, no event will tell about them
+	var recheck <-chan time.Time
+	// set while waiting for the next connection attempt
+	var retry <-chan time.Time
 
 	for {
-		if s.conn == nil {
+		s.failback()
+
+		if s.needsReconnect() && s.ReconnectBackoff.Ready() {
 			s.Reconnect()
-		} else {
+		}
+
+		if len(s.connected()) > 0 {
 			if err := s.SendFiles(); err != nil {
 				log.Printf("error sending files: %s", err)
-				s.Reconnect()
 			}
 		}
 
+		if events != nil && recheck == nil && s.reader.Pending() > 0 {
+			recheck = time.After(FileCheckInterval * time.Second)
+		}
+
+		if retry == nil && s.needsReconnect() {
+			retry = time.After(s.ReconnectBackoff.Remaining())
+		}
+
 		select {
 		case <-s.quit:
 			return
 		case <-keepalive.C:
-			if s.conn == nil {
-				continue
+			var failed []string
+			for _, c := range s.connected() {
+				if err := c.keepalive(); err != nil {
+					failed = append(failed, err.Error())
+					s.disconnect(c)
+				} else if time.Since(c.opened) >= s.ReconnectReset {
+					s.connectionWorks()
+				}
 			}
-
-			s.setTimeout()
-			if _, err := s.rw.WriteString("KEEPALIVE\n"); err != nil {
-				log.Printf("error sending keepalive: %s", err)
-				s.Reconnect()
-			} else {
-				_ = s.rw.Flush()
+			if len(failed) > 0 {
+				s.connectionFailed(fmt.Sprintf("error sending keepalive: %s", strings.Join(failed, "; ")))
 			}
 		case <-checkFiles.C:
 			continue
+		case <-recheck:
+			recheck = nil
+		case <-retry:
+			retry = nil
+		case _, ok := <-events:
+			if !ok {
+				log.Printf("Watching stopped, falling back to polling")
+				events = nil
+				checkFiles.Stop()
+				checkFiles = time.NewTicker(FileCheckInterval * time.Second)
+			}
 		}
 	}
 }
 
+// SendFiles sends all ready files of the spool, batch by batch when the reader limits them.
+//
+// Files of a batch are shared by all connected workers, every file is taken by exactly one of them.
+// Workers that fail are disconnected, their files stay in the spool for the next check.
 func (s *Sender) SendFiles() error {
-	files, err := s.reader.ReadDir()
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		s.setTimeout()
+	for {
+		select {
+		case <-s.quit:
+			return nil
+		default:
+		}
 
-		log.Printf("Sending file %s", file.RawName)
+		if s.paused() {
+			return nil
+		}
 
-		if _, err := s.rw.WriteString("SEND_FILE\n"); err != nil {
-			return fmt.Errorf("could not sent command: %s", err)
+		conns := s.connected()
+		if len(conns) == 0 {
+			return fmt.Errorf("not connected to %s", s.target())
 		}
 
-		enc := gob.NewEncoder(s.rw)
-		if err := enc.Encode(file); err != nil {
-			return fmt.Errorf("could not send encoded data: %s", err)
+		if s.Progress != nil {
+			// a batch only holds files this destination does not have yet
+			s.reader.Needed = s.needed
 		}
 
-		err = s.rw.Flush()
+		files, err := s.reader.ReadDir()
 		if err != nil {
-			return fmt.Errorf("could not flush data: %s", err)
+			return err
 		}
 
-		s.setTimeout()
-		response, err := s.rw.ReadString('\n')
+		sent, err := s.sendBatch(conns, files)
 		if err != nil {
-			return fmt.Errorf("error waiting for response for sent file: %s", err)
+			return err
+		}
+
+		// only continue when there is more, and files have been sent, otherwise the same batch would be read again
+		if !s.reader.More() || sent == 0 {
+			return nil
 		}
+	}
+}
+
+// sendBatch lets all connections send files from a shared queue, and returns how many files were sent
+func (s *Sender) sendBatch(conns []*connection, files []*FileData) (int, error) {
+	queue := make(chan *FileData, len(files))
+	for _, file := range files {
+		queue <- file
+	}
+	close(queue)
+
+	var (
+		wg     sync.WaitGroup
+		idle   sync.WaitGroup
+		mu     sync.Mutex
+		sent   int
+		errors []string
+	)
+
+	failed := func(c *connection, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		errors = append(errors, err.Error())
+		s.disconnect(c)
+	}
+
+	// closed when all connections are done, idle ones are kept alive until then
+	finished := make(chan bool)
+
+	for _, c := range conns {
+		wg.Add(1)
+		idle.Add(1)
+
+		go func(c *connection) {
+			defer idle.Done()
+
+			n, err := c.sendFiles(queue)
+
+			mu.Lock()
+			sent += n
+			mu.Unlock()
+
+			wg.Done()
 
-		response = strings.Trim(response, "\n")
-		if response == "OK" {
-			// Delete file when it was sent
-			err = s.reader.Delete(file.RawName)
 			if err != nil {
-				return err
+				failed(c, err)
+				return
 			}
-		} else {
-			return fmt.Errorf("peer did not acknowledge file and returned: %s", response)
-		}
+
+			if err := c.keepaliveUntil(finished); err != nil {
+				failed(c, err)
+			}
+		}(c)
+	}
+
+	wg.Wait()
+	close(finished)
+	idle.Wait()
+
+	if len(errors) > 0 {
+		err := fmt.Errorf("%s", strings.Join(errors, "; "))
+		// connections were lost, the next attempt waits like after a failed connect
+		s.connectionFailed("lost connection to " + s.target())
+		return sent, err
 	}
 
-	return nil
+	return sent, nil
 }
 
+// Stop ends Run, files in flight are still acknowledged by the receiver
 func (s *Sender) Stop() {
 	close(s.quit)
 }
 
 func (s *Sender) Close() error {
-	if s.conn != nil {
-		err := s.conn.Close()
-		s.conn = nil
-		s.rw = nil
-		if err != nil {
-			return err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+
+	for i, c := range s.conns {
+		if c == nil {
+			continue
+		}
+
+		if err := c.close(); err != nil && firstErr == nil {
+			firstErr = err
 		}
+		s.conns[i] = nil
 	}
 
-	return nil
+	return firstErr
 }
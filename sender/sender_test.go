@@ -1,5 +1,18 @@
 package sender
 
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
 /*
 import (
 	"fmt"
@@ -33,3 +46,192 @@ func TestNewSender(t *testing.T) {
 	s := NewSender()
 }
 */
+
+func TestSender_Reconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on the address anymore
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	s := NewSender(addr, &FileReader{})
+	s.ReconnectBackoff.Min = time.Minute
+
+	s.Reconnect()
+
+	if s.ReconnectBackoff.Ready() || s.ReconnectBackoff.Attempts() != 1 {
+		t.Fatal("failed connection attempt should start the backoff")
+	}
+
+	if status := s.Status(); !strings.Contains(status, "0 of 1 workers") || !strings.Contains(status, "1 failed") {
+		t.Fatalf("unexpected status: %s", status)
+	}
+}
+
+func TestSender_ConnectionLost(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drops the connection when a file is sent
+	l := fakeReceiver(t)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	s := NewSender(l.Addr().String(), r)
+	s.Checksum = ""
+	s.ReconnectBackoff.Min = time.Minute
+
+	s.Reconnect()
+	if err := s.SendFiles(); err == nil {
+		t.Fatal("sending should fail")
+	}
+
+	if s.ReconnectBackoff.Ready() || s.ReconnectBackoff.Attempts() != 1 {
+		t.Fatal("lost connection should delay the next connection attempt")
+	}
+
+	// handshake alone does not reset the backoff
+	s.Reconnect()
+	if s.ReconnectBackoff.Attempts() != 1 {
+		t.Fatal("backoff should only be reset once a file was acknowledged")
+	}
+
+	if err := s.SendFiles(); err == nil {
+		t.Fatal("sending should fail")
+	}
+
+	// unless asked for
+	s.ReconnectReset = 0
+	s.Reconnect()
+	if s.ReconnectBackoff.Attempts() != 0 {
+		t.Fatal("handshake should reset the backoff without ReconnectReset")
+	}
+}
+
+// acceptingReceiver answers the handshake without any capabilities, and acknowledges every file sent
+func acceptingReceiver(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+				if _, err := rw.ReadString('\n'); err != nil {
+					return
+				}
+				_, _ = rw.WriteString(NewHello("fake", nil).String() + "\n")
+				_ = rw.Flush()
+
+				for {
+					cmd, err := rw.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.TrimSpace(cmd) != "SEND_FILE" {
+						continue
+					}
+
+					var file FileData
+					if err := gob.NewDecoder(rw).Decode(&file); err != nil {
+						return
+					}
+					if _, err := io.CopyN(ioutil.Discard, rw, file.Remaining()); err != nil {
+						return
+					}
+
+					_, _ = rw.WriteString("OK\n")
+					_ = rw.Flush()
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestSender_DoneFailed(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	r, err := NewFileReader(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// can not be created below a file
+	r.Archive = path.Join(spool, ".gitignore", "archive")
+
+	l := acceptingReceiver(t)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	s := NewSender(l.Addr().String(), r)
+	s.Checksum = ""
+
+	s.Reconnect()
+	if err := s.SendFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.connected()) != 1 {
+		t.Fatal("connection should be kept, when a sent file could not be archived")
+	}
+
+	if len(s.failures) != FixtureFiles {
+		t.Fatalf("every file should count as failed, got %d", len(s.failures))
+	}
+}
+
+func TestKeepaliveReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	c := &connection{conn: client, rw: bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))}
+
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(server).ReadString('\n')
+		received <- line
+	}()
+
+	// hashing started a while ago
+	reader := &keepaliveReader{Reader: strings.NewReader("content"), conn: c, last: time.Now().Add(-time.Hour)}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+
+	if line := <-received; line != "KEEPALIVE\n" {
+		t.Fatalf("expected a keepalive, got %q", line)
+	}
+}
@@ -0,0 +1,169 @@
+package sender
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	watchFileMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+)
+
+// Watcher notifies when files have been written to or moved into the spool, based on inotify.
+//
+// Events are coalesced, a notification only means that the spool should be checked again.
+type Watcher struct {
+	path      string
+	recursive bool
+	fd        int
+	file      *os.File
+	events    chan bool
+	mu        sync.Mutex
+	// relative directory for each watch descriptor
+	watches map[int32]string
+}
+
+func NewWatcher(path string, recursive bool) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize inotify: %s", err)
+	}
+
+	w := &Watcher{
+		path:      path,
+		recursive: recursive,
+		fd:        fd,
+		// non blocking descriptors are handled by the runtime poller, so Close interrupts a pending read
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  make(chan bool, 1),
+		watches: make(map[int32]string),
+	}
+
+	if err := w.addWatch(""); err != nil {
+		_ = w.file.Close()
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// Events returns the channel that receives a value when the spool has changed
+func (w *Watcher) Events() <-chan bool {
+	return w.events
+}
+
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+// addWatch watches a directory and, in recursive mode, all of its subdirectories
+func (w *Watcher) addWatch(dir string) error {
+	mask := uint32(watchFileMask)
+	if w.recursive {
+		mask |= syscall.IN_CREATE
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, path.Join(w.path, dir), mask)
+	if err != nil {
+		return fmt.Errorf("could not watch directory %s: %s", path.Join(w.path, dir), err)
+	}
+
+	w.mu.Lock()
+	w.watches[int32(wd)] = dir
+	w.mu.Unlock()
+
+	if !w.recursive {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(path.Join(w.path, dir))
+	if err != nil {
+		return fmt.Errorf("could not read directory %s: %s", path.Join(w.path, dir), err)
+	}
+
+	for _, file := range files {
+		relPath := path.Join(dir, file.Name())
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") || relPath == QuarantineDir {
+			continue
+		}
+
+		if err := w.addWatch(relPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Watcher) notify() {
+	select {
+	case w.events <- true:
+	default:
+		// a notification is already pending
+	}
+}
+
+func (w *Watcher) run() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != os.ErrClosed {
+				log.Printf("error reading inotify events: %s", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			w.handleEvent(event, name)
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(event *syscall.InotifyEvent, name string) {
+	switch {
+	case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+		// events were lost, a full check finds everything
+		w.notify()
+	case event.Mask&syscall.IN_IGNORED != 0:
+		w.mu.Lock()
+		delete(w.watches, event.Wd)
+		w.mu.Unlock()
+	case event.Mask&syscall.IN_ISDIR != 0:
+		w.mu.Lock()
+		dir, ok := w.watches[event.Wd]
+		w.mu.Unlock()
+
+		relPath := path.Join(dir, name)
+		if !ok || !w.recursive || strings.HasPrefix(name, ".") || relPath == QuarantineDir {
+			return
+		}
+
+		// files might have been written before the watch was in place
+		if err := w.addWatch(relPath); err != nil {
+			log.Printf("error watching new directory: %s", err)
+		}
+		w.notify()
+	case event.Mask&watchFileMask != 0:
+		if !strings.HasPrefix(name, ".") {
+			w.notify()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package sender
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, w *Watcher, expected bool) {
+	select {
+	case <-w.Events():
+		if !expected {
+			t.Fatal("received an unexpected event")
+		}
+	case <-time.After(500 * time.Millisecond):
+		if expected {
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	w, err := NewWatcher(spool, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, w, false)
+
+	writeFile(t, spool, "new-file", TestContent)
+	expectEvent(t, w, true)
+
+	// writing a dotfile and moving it into place
+	writeFile(t, spool, ".moved", TestContent)
+	expectEvent(t, w, false)
+	if err := os.Rename(path.Join(spool, ".moved"), path.Join(spool, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, true)
+
+	// subdirectories are not watched
+	writeFile(t, path.Join(spool, "directory"), "sub-file", TestContent)
+	expectEvent(t, w, false)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-w.Events(); ok {
+		t.Fatal("events should be closed after Close")
+	}
+}
+
+func TestWatcher_Recursive(t *testing.T) {
+	spool := createFixture(t)
+	defer func() {
+		_ = os.RemoveAll(spool)
+	}()
+
+	w, err := NewWatcher(spool, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+
+	writeFile(t, path.Join(spool, "directory"), "sub-file", TestContent)
+	expectEvent(t, w, true)
+
+	if err := os.Mkdir(path.Join(spool, "new-directory"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, true)
+
+	writeFile(t, path.Join(spool, "new-directory"), "sub-file", TestContent)
+	expectEvent(t, w, true)
+}
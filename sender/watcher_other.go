@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package sender
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Watcher is only supported on Linux, the sender falls back to polling elsewhere
+type Watcher struct{}
+
+func NewWatcher(_ string, _ bool) (*Watcher, error) {
+	return nil, fmt.Errorf("watching for files is not supported on %s", runtime.GOOS)
+}
+
+func (w *Watcher) Events() <-chan bool {
+	return nil
+}
+
+func (w *Watcher) Close() error {
+	return nil
+}
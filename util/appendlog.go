@@ -0,0 +1,138 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// AppendLog is a file of lines, every line is synced to disk when it is appended.
+//
+// The state kept in the lines is rewritten from time to time, so the file does not grow forever.
+// A rewrite goes to a temp file, which replaces the log and is persisted with its directory.
+type AppendLog struct {
+	path string
+	file *os.File
+}
+
+func NewAppendLog(path string) *AppendLog {
+	return &AppendLog{path: path}
+}
+
+// Load calls fn for every line of the log, a missing log has no lines.
+//
+// The last line might be incomplete after a crash, fn has to ignore lines it can not parse.
+func (l *AppendLog) Load(fn func(line string)) error {
+	fh, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open %s: %s", l.path, err)
+	}
+
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %s: %s", l.path, err)
+	}
+
+	return nil
+}
+
+// Rewrite replaces the log with the lines fn writes, and opens it for appending
+func (l *AppendLog) Rewrite(fn func(w io.Writer)) error {
+	fh, err := ioutil.TempFile(path.Dir(l.path), path.Base(l.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not rewrite %s: %s", l.path, err)
+	}
+
+	tempPath := fh.Name()
+	defer func() {
+		// only exists when something failed before the rename
+		_ = os.Remove(tempPath)
+	}()
+
+	w := bufio.NewWriter(fh)
+	fn(w)
+
+	err = w.Flush()
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, l.path)
+	}
+	if err == nil {
+		// lines appended after the rename must not end up in the old file after a crash
+		err = SyncDir(path.Dir(l.path))
+	}
+	if err != nil {
+		return fmt.Errorf("could not rewrite %s: %s", l.path, err)
+	}
+
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", l.path, err)
+	}
+
+	return nil
+}
+
+// Append writes a line to the log, it is synced to disk before returning
+func (l *AppendLog) Append(line string) error {
+	if l.file == nil {
+		return fmt.Errorf("%s is not open", l.path)
+	}
+
+	if _, err := l.file.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("could not write %s: %s", l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("could not write %s: %s", l.path, err)
+	}
+
+	return nil
+}
+
+func (l *AppendLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// SyncDir makes sure a rename inside dir is persisted
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestAppendLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appendlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	logPath := path.Join(dir, "log")
+	l := NewAppendLog(logPath)
+
+	if err := l.Append("a"); err == nil {
+		t.Fatal("append should fail before the log is rewritten")
+	}
+
+	if err := l.Rewrite(func(w io.Writer) { _, _ = fmt.Fprintln(w, "a") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	if err := NewAppendLog(logPath).Load(func(line string) { lines = append(lines, line) }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []string{"a", "b"}) {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temp files should be gone, found %d files", len(files))
+	}
+
+	if err := NewAppendLog(path.Join(dir, "missing")).Load(func(string) { t.Fatal("missing log has no lines") }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff calculates exponentially growing delays between attempts, with random jitter.
+//
+// The delay starts at Min and doubles with every failed attempt, up to Max. Half of the delay is random,
+// so many clients that failed at the same time don't retry at the same time.
+type Backoff struct {
+	// Min is the delay after the first failed attempt
+	Min time.Duration
+	// Max limits the delay
+	Max time.Duration
+
+	mu       sync.Mutex
+	attempts int
+	next     time.Time
+	// every Backoff has its own source, so processes started at the same time don't wait the same delays
+	rand *rand.Rand
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{
+		Min:  min,
+		Max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Failed records a failed attempt and returns the delay until the next one
+func (b *Backoff) Failed() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attempts++
+
+	if b.rand == nil {
+		b.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	delay := b.Min
+	for i := 1; i < b.attempts && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+
+	if half := delay / 2; half > 0 {
+		delay = half + time.Duration(b.rand.Int63n(int64(half)+1))
+	}
+
+	b.next = time.Now().Add(delay)
+
+	return delay
+}
+
+// Reset forgets failed attempts, the next attempt can be made right away
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attempts = 0
+	b.next = time.Time{}
+}
+
+// Ready returns true when the delay since the last failed attempt has passed
+func (b *Backoff) Ready() bool {
+	return b.Remaining() == 0
+}
+
+// Remaining returns the time until the next attempt
+func (b *Backoff) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if remaining := time.Until(b.next); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Attempts returns the number of failed attempts since the last reset
+func (b *Backoff) Attempts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.attempts
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second)
+
+	if !b.Ready() {
+		t.Fatal("backoff should be ready before any failure")
+	}
+
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		delay := b.Failed()
+		max *= time.Second
+
+		if delay < max/2 || delay > max {
+			t.Fatalf("delay %s for attempt %d should be between %s and %s", delay, i+1, max/2, max)
+		}
+	}
+
+	if b.Ready() || b.Attempts() != 6 {
+		t.Fatalf("backoff should wait after %d failed attempts", b.Attempts())
+	}
+
+	b.Reset()
+
+	if !b.Ready() || b.Attempts() != 0 || b.Remaining() != 0 {
+		t.Fatal("backoff should be ready after reset")
+	}
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// DeadlineReader extends the read deadline of Conn before every read on Reader.
+//
+// Used to stream large amounts of data without running into a fixed deadline.
+type DeadlineReader struct {
+	Reader  io.Reader
+	Conn    net.Conn
+	Timeout time.Duration
+}
+
+func (r *DeadlineReader) Read(p []byte) (int, error) {
+	if err := r.Conn.SetReadDeadline(time.Now().Add(r.Timeout)); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// DeadlineWriter extends the write deadline of Conn before every write on Writer.
+type DeadlineWriter struct {
+	Writer  io.Writer
+	Conn    net.Conn
+	Timeout time.Duration
+}
+
+func (w *DeadlineWriter) Write(p []byte) (int, error) {
+	if err := w.Conn.SetWriteDeadline(time.Now().Add(w.Timeout)); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
+}
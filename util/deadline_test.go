@@ -0,0 +1,49 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadlineReaderWriter(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+
+	go func() {
+		w := &DeadlineWriter{Writer: client, Conn: client, Timeout: time.Second}
+		_, _ = w.Write(data)
+	}()
+
+	r := &DeadlineReader{Reader: server, Conn: server, Timeout: time.Second}
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(r, received); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, received) {
+		t.Fatal("received data does not match")
+	}
+}
+
+func TestDeadlineReaderTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	r := &DeadlineReader{Reader: server, Conn: server, Timeout: 10 * time.Millisecond}
+	_, err := r.Read(make([]byte, 1))
+
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+}